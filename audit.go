@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// ---------- audit trail ----------
+
+// 每次寫回實際改變的欄位各記一列，與 UPDATE 同一個交易寫入；undo 依此還原。
+// 只記值有變的欄位，status / recompute_info 也各記一列。
+const auditTable = "acc_recompute_audit"
+
+// 一個欄位的變更；指標為 nil 代表 NULL（或不適用）
+type auditRow struct {
+	RunID      string
+	Table      string
+	RecordID   uint64
+	Column     string
+	OldValue   *string
+	NewValue   *string
+	RateKey    *string // 金額欄位：例如 PHP->CNY@2024-01-05 path=PHP->USDT->CNY direction=inverse
+	Rate       *string
+	OfficePath *string // 辦公室欄位：例如 site_code=S01: data_office_site#3 -> data_office_sub#7 -> data_office_main#1
+}
+
+func ensureAuditTable(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).Exec("CREATE TABLE IF NOT EXISTS `" + auditTable + "` (" +
+		"`id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT," +
+		"`run_id` VARCHAR(64) NOT NULL," +
+		"`table_name` VARCHAR(64) NOT NULL," +
+		"`record_id` BIGINT UNSIGNED NOT NULL," +
+		"`column_name` VARCHAR(64) NOT NULL," +
+		"`old_value` TEXT NULL," +
+		"`new_value` TEXT NULL," +
+		"`rate_key` VARCHAR(255) NULL," +
+		"`rate` VARCHAR(64) NULL," +
+		"`office_path` VARCHAR(255) NULL," +
+		"`created_at` DATETIME(6) NOT NULL," +
+		"PRIMARY KEY (`id`)," +
+		"KEY `idx_run` (`run_id`, `table_name`, `record_id`)," +
+		"KEY `idx_record` (`table_name`, `record_id`)" +
+		") DEFAULT CHARSET=utf8mb4").Error
+}
+
+// 比對 computeUpdateCached 的結果與讀取時的值，回傳有變的欄位；trace 提供匯率與辦公室來源
+func auditRows(runID, table string, mapping FieldMapping, rec recordRow, upd map[string]any, trace *computeTrace) []auditRow {
+	rates := map[string][2]string{} // 換算後欄位 -> rate key, rate
+	for _, st := range trace.Sets {
+		for _, o := range st.Outputs {
+			key := o.Target + "->" + o.Target // 與原幣相同，直接沿用 base
+			for _, l := range st.Lookups {
+				if l.Err == nil && l.To == o.Target {
+					key = auditRateKey(l)
+				}
+			}
+			rates[o.Column] = [2]string{key, o.Rate.String()}
+		}
+	}
+	isOffice := map[string]bool{}
+	for _, c := range officeColumns(mapping) {
+		isOffice[c] = true
+	}
+	officePath := auditOfficePath(rec, trace)
+
+	var out []auditRow
+	for _, c := range sortedKeys(upd) {
+		if c == mapping.IDColumn {
+			continue
+		}
+		newVal := valueString(upd[c])
+		var oldVal *string
+		changed := true
+		switch {
+		case c == "status":
+			s := strconv.Itoa(rec.Status)
+			oldVal = &s
+			changed = !equalStringPtr(oldVal, newVal)
+		case c == "recompute_info":
+			oldVal = nullStringPtr(rec.RecomputeInfo)
+			changed = !equalStringPtr(oldVal, newVal)
+		default:
+			if amt, ok := rec.Amounts[c]; ok {
+				oldVal = valueString(amt)
+				nd, isDec := upd[c].(decimal.Decimal)
+				changed = !(amt.Valid && isDec && amt.Decimal.Equal(nd))
+			} else if off, ok := rec.Offices[c]; ok {
+				oldVal = nullStringPtr(off)
+				changed = !equalStringPtr(oldVal, newVal)
+			}
+		}
+		if !changed {
+			continue
+		}
+		r := auditRow{RunID: runID, Table: table, RecordID: rec.ID, Column: c, OldValue: oldVal, NewValue: newVal}
+		if kr, ok := rates[c]; ok {
+			r.RateKey, r.Rate = &kr[0], &kr[1]
+		}
+		if isOffice[c] && officePath != "" {
+			r.OfficePath = &officePath
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func auditRateKey(l rateLookup) string {
+	key := fmt.Sprintf("%s->%s@%s", l.From, l.To, l.Hit.Date)
+	if l.Hit.Path != "" {
+		key += " path=" + l.Hit.Path
+	}
+	if l.Hit.Direction == rateInverse {
+		key += " direction=" + rateInverse
+	}
+	return key
+}
+
+func auditOfficePath(rec recordRow, t *computeTrace) string {
+	if t.OfficeReason != "" {
+		return ""
+	}
+	o := t.Office
+	switch t.OfficePath {
+	case officePathSite:
+		return fmt.Sprintf("site_code=%s: data_office_site#%d -> data_office_sub#%d -> data_office_main#%d", rec.SiteCode, o.SiteID, o.SubID, o.MainID)
+	case officePathSub:
+		return fmt.Sprintf("sub_code=%s: data_office_sub#%d -> data_office_main#%d", rec.SubCode, o.SubID, o.MainID)
+	}
+	return ""
+}
+
+// 每條 INSERT 最多幾列，避免單一語句參數過多
+const auditInsertChunk = 500
+
+// 寫入稽核紀錄；時間用 DB 的 NOW(6)，與 retry 旁表一致
+func insertAudit(ctx context.Context, tx *gorm.DB, rows []auditRow) error {
+	for start := 0; start < len(rows); start += auditInsertChunk {
+		chunk := rows[start:min(start+auditInsertChunk, len(rows))]
+		q := "INSERT INTO `" + auditTable + "` (run_id, table_name, record_id, column_name, old_value, new_value, rate_key, rate, office_path, created_at) VALUES "
+		args := make([]any, 0, len(chunk)*9)
+		for i, r := range chunk {
+			if i > 0 {
+				q += ","
+			}
+			q += "(?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(6))"
+			args = append(args, r.RunID, r.Table, r.RecordID, r.Column, r.OldValue, r.NewValue, r.RateKey, r.Rate, r.OfficePath)
+		}
+		if err := tx.WithContext(ctx).Exec(q, args...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ---------- undo ----------
+
+// 這次執行對一個欄位的變更（同一欄位被改多次時取最早的舊值、最後的新值）
+type auditChange struct {
+	Column string
+	Old    *string
+	New    *string
+}
+
+type undoRecord struct {
+	Table   string
+	ID      uint64
+	Changes []auditChange
+}
+
+// 無法還原的欄位：現值已不是這次執行寫入的值，或資料已刪除
+type undoConflict struct {
+	Table   string
+	ID      uint64
+	Column  string
+	Want    *string // 這次執行寫入的值
+	Current *string
+	Missing bool
+}
+
+type undoResult struct {
+	Records   int // audit 中被這次執行改過的資料筆數
+	Restored  int // 所有欄位都還原
+	Partial   int // 部分欄位有衝突，只還原其餘欄位
+	Skipped   int // 沒有任何欄位能還原（全部衝突或資料已刪除）
+	Conflicts []undoConflict
+}
+
+// keepStatus 時不還原的欄位：status 改回 2 會讓 daemon 用目前的匯率重新處理
+var undoStatusColumns = map[string]bool{"status": true, "recompute_info": true}
+
+// 依 run_id 撈出稽核紀錄，依表、id 分組；table 非空時只取該表
+func loadRunAudit(ctx context.Context, db *gorm.DB, runID, table string) ([]undoRecord, error) {
+	q := "SELECT table_name, record_id, column_name, old_value, new_value FROM `" + auditTable + "` WHERE run_id = ?"
+	args := []any{runID}
+	if table != "" {
+		q += " AND table_name = ?"
+		args = append(args, table)
+	}
+	rows, err := db.WithContext(ctx).Raw(q+" ORDER BY table_name, record_id, id", args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []undoRecord
+	for rows.Next() {
+		var tbl, col string
+		var id uint64
+		var oldVal, newVal sql.NullString
+		if err := rows.Scan(&tbl, &id, &col, &oldVal, &newVal); err != nil {
+			return nil, err
+		}
+		if n := len(out); n == 0 || out[n-1].Table != tbl || out[n-1].ID != id {
+			out = append(out, undoRecord{Table: tbl, ID: id})
+		}
+		rec := &out[len(out)-1]
+		merged := false
+		for i := range rec.Changes {
+			if rec.Changes[i].Column == col {
+				rec.Changes[i].New = nullStringPtr(newVal)
+				merged = true
+			}
+		}
+		if !merged {
+			rec.Changes = append(rec.Changes, auditChange{Column: col, Old: nullStringPtr(oldVal), New: nullStringPtr(newVal)})
+		}
+	}
+	return out, rows.Err()
+}
+
+// 還原一次執行的寫回。以欄位為單位：現值還是這次執行寫入的值的欄位才還原，其餘欄位回報衝突。
+// keepStatus 時不動 status / recompute_info，只還原金額與辦公室欄位。
+// 還原本身在 audit 啟用時也會記一筆（run_id 為這次 undo 的 run_id）。
+func undoRun(ctx context.Context, env *recomputeEnv, runID, table string, keepStatus bool) (undoResult, error) {
+	res := undoResult{}
+	recs, err := loadRunAudit(ctx, env.DB, runID, table)
+	if err != nil {
+		return res, fmt.Errorf("load audit: %w", err)
+	}
+	res.Records = len(recs)
+	for start := 0; start < len(recs) && ctx.Err() == nil; {
+		// 同一張表的連續資料，最多 batch size 筆一個交易
+		end := start + 1
+		for end < len(recs) && end-start < env.Cfg.RecomputeBatchSize && recs[end].Table == recs[start].Table {
+			end++
+		}
+		if err := undoChunk(ctx, env, recs[start:end], keepStatus, &res); err != nil {
+			return res, fmt.Errorf("%s: %w", recs[start].Table, err)
+		}
+		start = end
+	}
+	env.Logger.Info("undo", "undo_run_id", runID, logKeyTable, table, "records", res.Records, "restored", res.Restored,
+		"partial", res.Partial, "skipped", res.Skipped, "keep_status", keepStatus, "conflicts", len(res.Conflicts))
+	return res, nil
+}
+
+func undoChunk(ctx context.Context, env *recomputeEnv, recs []undoRecord, keepStatus bool, res *undoResult) error {
+	table := recs[0].Table
+	mapping, _, ok := tableMapping(table)
+	if !ok {
+		return fmt.Errorf("table %q is not mapped, cannot find its id column", table)
+	}
+	colIdx := map[string]int{}
+	cols := []string{}
+	for _, r := range recs {
+		for _, ch := range r.Changes {
+			if _, seen := colIdx[ch.Column]; seen {
+				continue
+			}
+			if !identRe.MatchString(ch.Column) {
+				return fmt.Errorf("audit column %q is not a valid column name", ch.Column)
+			}
+			colIdx[ch.Column] = len(cols)
+			cols = append(cols, ch.Column)
+		}
+	}
+	ids := make([]uint64, len(recs))
+	for i, r := range recs {
+		ids[i] = r.ID
+	}
+
+	var conflicts []undoConflict
+	restored, partial, skipped := 0, 0, 0
+	wctx, cancel := writeContext(ctx)
+	defer cancel()
+	err := env.DB.WithContext(wctx).Transaction(func(tx *gorm.DB) error {
+		q := fmt.Sprintf("SELECT `%s`, `%s` FROM `%s` WHERE `%s` IN ? FOR UPDATE",
+			mapping.IDColumn, strings.Join(cols, "`, `"), table, mapping.IDColumn)
+		rows, err := tx.Raw(q, ids).Rows()
+		if err != nil {
+			return err
+		}
+		current := map[uint64][]sql.NullString{}
+		for rows.Next() {
+			var id uint64
+			vals := make([]sql.NullString, len(cols))
+			targets := []any{&id}
+			for i := range vals {
+				targets = append(targets, &vals[i])
+			}
+			if err := rows.Scan(targets...); err != nil {
+				rows.Close()
+				return err
+			}
+			current[id] = vals
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		var audit []auditRow
+		for _, r := range recs {
+			vals, found := current[r.ID]
+			set := make(map[string]any, len(r.Changes))
+			bad := 0
+			for _, ch := range r.Changes {
+				if keepStatus && undoStatusColumns[ch.Column] {
+					continue
+				}
+				c := undoConflict{Table: table, ID: r.ID, Column: ch.Column, Want: ch.New, Missing: !found}
+				if !found {
+					conflicts = append(conflicts, c)
+					bad++
+					continue
+				}
+				if cur := vals[colIdx[ch.Column]]; !sameAuditValue(cur, ch.New) {
+					c.Current = nullStringPtr(cur)
+					conflicts = append(conflicts, c)
+					bad++
+					continue
+				}
+				if ch.Old == nil {
+					set[ch.Column] = nil
+				} else {
+					set[ch.Column] = *ch.Old
+				}
+				audit = append(audit, auditRow{RunID: env.RunID, Table: table, RecordID: r.ID, Column: ch.Column, OldValue: ch.New, NewValue: ch.Old})
+			}
+			switch {
+			case len(set) == 0 && bad > 0:
+				skipped++
+				continue
+			case len(set) == 0:
+				continue // keepStatus 時只改了 status / recompute_info 的資料
+			case bad > 0:
+				partial++
+			default:
+				restored++
+			}
+			if err := tx.Table(table).Where(fmt.Sprintf("`%s` = ?", mapping.IDColumn), r.ID).Updates(set).Error; err != nil {
+				return err
+			}
+		}
+		if env.Cfg.Audit {
+			return insertAudit(wctx, tx, audit)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	res.Restored += restored
+	res.Partial += partial
+	res.Skipped += skipped
+	res.Conflicts = append(res.Conflicts, conflicts...)
+	return nil
+}
+
+// 現值是否仍是這次執行寫入的值；DECIMAL 讀回來會補零（1.2 -> 1.200000），數字以數值比較
+func sameAuditValue(cur sql.NullString, want *string) bool {
+	if !cur.Valid || want == nil {
+		return !cur.Valid && want == nil
+	}
+	if cur.String == *want {
+		return true
+	}
+	a, err1 := decimal.NewFromString(cur.String)
+	b, err2 := decimal.NewFromString(*want)
+	return err1 == nil && err2 == nil && a.Equal(b)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestSameAuditValue(t *testing.T) {
+	null := sql.NullString{}
+	val := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	tests := []struct {
+		name string
+		cur  sql.NullString
+		want *string
+		same bool
+	}{
+		{name: "both NULL", cur: null, want: nil, same: true},
+		{name: "NULL vs value", cur: null, want: sp("1"), same: false},
+		{name: "value vs NULL", cur: val("1"), want: nil, same: false},
+		{name: "empty string is not NULL", cur: val(""), want: nil, same: false},
+		{name: "same text", cur: val("Manila"), want: sp("Manila"), same: true},
+		{name: "different text", cur: val("Manila"), want: sp("manila"), same: false},
+		{name: "decimal padding", cur: val("1.200000"), want: sp("1.2"), same: true},
+		{name: "integer vs decimal", cur: val("8.00"), want: sp("8"), same: true},
+		{name: "different number", cur: val("1.200001"), want: sp("1.2"), same: false},
+		{name: "number vs text", cur: val("1.2"), want: sp("1.2x"), same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameAuditValue(tt.cur, tt.want); got != tt.same {
+				t.Errorf("sameAuditValue(%+v, %s) = %v, want %v", tt.cur, nullText(tt.want), got, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	mysqldrv "github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+)
+
+// ---------- compare-and-set ----------
+
+// 讀取到寫回之間，應用程式可能已經改過或重新核准這筆資料；
+// 寫回時 status 與版本欄位（若有）都要與讀取時相同才寫，否則略過並計入 Conflicts。
+
+// version_column 設成這個值代表不用版本欄位，只比對 status
+const versionColumnNone = "-"
+
+// 沒設定 version_column 時依序偵測的欄位，取第一個存在的
+var versionColumnCandidates = []string{"version", "updated_at"}
+
+// 讀取時的值
+type rowGuard struct {
+	Status  int
+	Version any // 沒有版本欄位時為 nil
+}
+
+func (m FieldMapping) versionColumn() string {
+	if m.VersionColumn == versionColumnNone {
+		return ""
+	}
+	return m.VersionColumn
+}
+
+// 沒設定 version_column 的表從 schema 找 version / updated_at；schema 中沒有的表只比對 status
+func detectVersionColumns(schema map[string]tableColumns, mappings map[string]FieldMapping, order []string, logger *slog.Logger) {
+	for _, tbl := range order {
+		m := mappings[tbl]
+		if m.VersionColumn == "" {
+			for _, c := range versionColumnCandidates {
+				if ci, ok := schema[tbl][c]; ok {
+					m.VersionColumn = ci.Name
+					break
+				}
+			}
+			mappings[tbl] = m
+		}
+		logger.Info("compare-and-set", logKeyTable, tbl, "version_column", m.versionColumn())
+	}
+}
+
+// 交易內鎖住這批資料（SELECT ... FOR UPDATE）並比對讀取時的值，
+// 回傳已被修改或刪除的 id；鎖住後到交易結束前不會再被改，UPDATE 的條件只是保險
+func lockAndCompare(ctx context.Context, tx *gorm.DB, table string, mapping FieldMapping, guards map[uint64]rowGuard) ([]uint64, error) {
+	if len(guards) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint64, 0, len(guards))
+	for id := range guards {
+		ids = append(ids, id)
+	}
+	versionCol := mapping.versionColumn()
+	cols := fmt.Sprintf("`%s`, `status`", mapping.IDColumn)
+	if versionCol != "" {
+		cols += fmt.Sprintf(", `%s`", versionCol)
+	}
+	q := fmt.Sprintf("SELECT %s FROM `%s` WHERE `%s` IN ? FOR UPDATE", cols, table, mapping.IDColumn)
+	rows, err := tx.WithContext(ctx).Raw(q, ids).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	same := make(map[uint64]bool, len(guards))
+	for rows.Next() {
+		var id uint64
+		var cur rowGuard
+		targets := []any{&id, &cur.Status}
+		if versionCol != "" {
+			targets = append(targets, &cur.Version)
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		g := guards[id]
+		same[id] = cur.Status == g.Status && sameVersion(cur.Version, g.Version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var conflicts []uint64
+	for _, id := range ids {
+		if !same[id] {
+			conflicts = append(conflicts, id)
+		}
+	}
+	return conflicts, nil
+}
+
+// 同一欄位兩次讀到的 driver value：DATETIME 為 time.Time（parseTime）或 []byte，整數為 int64
+func sameVersion(a, b any) bool {
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case time.Time:
+		bv, ok := b.(time.Time)
+		return ok && av.Equal(bv)
+	case []byte:
+		bv, ok := b.([]byte)
+		return ok && bytes.Equal(av, bv)
+	default:
+		return a == b
+	}
+}
+
+// 把比對失敗的 id 從這批移除並計入 Conflicts
+func (pb *preparedBatch) dropConflicts(ids []uint64, idCol string, terminalStatus int) {
+	pb.dropRows(ids, idCol, terminalStatus)
+	pb.Stats.Conflicts += len(ids)
+}
+
+// 把沒寫回的 id 從這批移除並調整統計，重試紀錄與稽核也不會有這些 id
+func (pb *preparedBatch) dropRows(ids []uint64, idCol string, terminalStatus int) {
+	skip := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		skip[id] = true
+	}
+	kept := make([]map[string]any, 0, len(pb.Updates))
+	for _, row := range pb.Updates {
+		if !skip[row[idCol].(uint64)] {
+			kept = append(kept, row)
+			continue
+		}
+		switch row["status"] {
+		case 1:
+			pb.Stats.Converted--
+		case terminalStatus:
+			pb.Stats.Failed--
+			pb.Stats.Terminal--
+		default:
+			pb.Stats.Failed--
+		}
+	}
+	pb.Updates = kept
+	succeeded := make([]uint64, 0, len(pb.Succeeded))
+	for _, id := range pb.Succeeded {
+		if !skip[id] {
+			succeeded = append(succeeded, id)
+		}
+	}
+	pb.Succeeded = succeeded
+	for id := range skip {
+		delete(pb.Failed, id)
+	}
+	audit := pb.Audit[:0:0]
+	for _, r := range pb.Audit {
+		if !skip[r.RecordID] {
+			audit = append(audit, r)
+		}
+	}
+	pb.Audit = audit
+}
+
+// 寫回交易重來時用的複本；dropRows 只會替換 slice、刪 Failed 的 key，不會改 Updates 裡的 map
+func (pb *preparedBatch) clone() preparedBatch {
+	c := *pb
+	c.Updates = slices.Clone(pb.Updates)
+	c.Succeeded = slices.Clone(pb.Succeeded)
+	c.Failed = maps.Clone(pb.Failed)
+	c.Audit = slices.Clone(pb.Audit)
+	return c
+}
+
+// 慢車道 UPDATE 影響 0 筆時確認條件是否仍成立（成立代表值本來就相同）
+func stillGuarded(ctx context.Context, tx *gorm.DB, table string, mapping FieldMapping, id uint64, g rowGuard) (bool, error) {
+	q := fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE `%s` = ? AND status = ?", table, mapping.IDColumn)
+	args := []any{id, g.Status}
+	if versionCol := mapping.versionColumn(); versionCol != "" {
+		q += fmt.Sprintf(" AND `%s` <=> ?", versionCol)
+		args = append(args, g.Version)
+	}
+	var n int64
+	if err := tx.WithContext(ctx).Raw(q, args...).Scan(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// MySQL 1213 deadlock / 1205 lock wait timeout：交易已（或應）rollback，整個重來即可
+func isLockError(err error) bool {
+	var me *mysqldrv.MySQLError
+	return errors.As(err, &me) && (me.Number == 1213 || me.Number == 1205)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	mysqldrv "github.com/go-sql-driver/mysql"
+)
+
+func TestSameVersion(t *testing.T) {
+	t1 := time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		a, b any
+		want bool
+	}{
+		{name: "both nil", a: nil, b: nil, want: true},
+		{name: "nil vs value", a: nil, b: int64(1), want: false},
+		{name: "value vs nil", a: int64(1), b: nil, want: false},
+		{name: "same int", a: int64(3), b: int64(3), want: true},
+		{name: "different int", a: int64(3), b: int64(4), want: false},
+		{name: "same time other zone", a: t1, b: t1.In(time.FixedZone("UTC+8", 8*3600)), want: true},
+		{name: "different time", a: t1, b: t1.Add(time.Second), want: false},
+		{name: "time vs bytes", a: t1, b: []byte("2024-01-05 10:00:00"), want: false},
+		{name: "same bytes", a: []byte("2024-01-05 10:00:00"), b: []byte("2024-01-05 10:00:00"), want: true},
+		{name: "different bytes", a: []byte("2024-01-05 10:00:00"), b: []byte("2024-01-05 10:00:01"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameVersion(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameVersion(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// 1 成功、2 失敗、3 轉為 terminal_status、4 成功
+func testPreparedBatch() preparedBatch {
+	return preparedBatch{
+		IDs:   []uint64{1, 2, 3, 4},
+		Stats: batchStats{Fetched: 4, Converted: 2, Failed: 2, Terminal: 1},
+		Updates: []map[string]any{
+			{"id": uint64(1), "status": 1},
+			{"id": uint64(2), "status": 2},
+			{"id": uint64(3), "status": 3},
+			{"id": uint64(4), "status": 1},
+		},
+		Succeeded: []uint64{1, 4},
+		Failed:    map[uint64]string{2: "no rate", 3: "no rate"},
+		Audit: []auditRow{
+			{RecordID: 1, Column: "amount_cny"},
+			{RecordID: 1, Column: "status"},
+			{RecordID: 2, Column: "recompute_info"},
+			{RecordID: 3, Column: "status"},
+			{RecordID: 4, Column: "status"},
+		},
+	}
+}
+
+func TestDropConflicts(t *testing.T) {
+	tests := []struct {
+		name          string
+		ids           []uint64
+		wantStats     batchStats
+		wantUpdates   []uint64
+		wantSucceeded []uint64
+		wantFailed    []uint64
+		wantAudit     []uint64
+	}{
+		{
+			name:          "none",
+			wantStats:     batchStats{Fetched: 4, Converted: 2, Failed: 2, Terminal: 1},
+			wantUpdates:   []uint64{1, 2, 3, 4},
+			wantSucceeded: []uint64{1, 4},
+			wantFailed:    []uint64{2, 3},
+			wantAudit:     []uint64{1, 1, 2, 3, 4},
+		},
+		{
+			name:          "converted row",
+			ids:           []uint64{1},
+			wantStats:     batchStats{Fetched: 4, Converted: 1, Failed: 2, Terminal: 1, Conflicts: 1},
+			wantUpdates:   []uint64{2, 3, 4},
+			wantSucceeded: []uint64{4},
+			wantFailed:    []uint64{2, 3},
+			wantAudit:     []uint64{2, 3, 4},
+		},
+		{
+			name:          "failed and terminal rows",
+			ids:           []uint64{2, 3},
+			wantStats:     batchStats{Fetched: 4, Converted: 2, Conflicts: 2},
+			wantUpdates:   []uint64{1, 4},
+			wantSucceeded: []uint64{1, 4},
+			wantFailed:    []uint64{},
+			wantAudit:     []uint64{1, 1, 4},
+		},
+		{
+			name:          "all",
+			ids:           []uint64{4, 3, 2, 1},
+			wantStats:     batchStats{Fetched: 4, Conflicts: 4},
+			wantUpdates:   []uint64{},
+			wantSucceeded: []uint64{},
+			wantFailed:    []uint64{},
+			wantAudit:     []uint64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb := testPreparedBatch()
+			pb.dropConflicts(tt.ids, "id", 3)
+			if pb.Stats != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", pb.Stats, tt.wantStats)
+			}
+			updates := []uint64{}
+			for _, r := range pb.Updates {
+				updates = append(updates, r["id"].(uint64))
+			}
+			failed := []uint64{}
+			for _, id := range []uint64{1, 2, 3, 4} {
+				if _, ok := pb.Failed[id]; ok {
+					failed = append(failed, id)
+				}
+			}
+			audit := []uint64{}
+			for _, r := range pb.Audit {
+				audit = append(audit, r.RecordID)
+			}
+			for _, c := range []struct {
+				what      string
+				got, want []uint64
+			}{
+				{"updates", updates, tt.wantUpdates},
+				{"succeeded", pb.Succeeded, tt.wantSucceeded},
+				{"failed", failed, tt.wantFailed},
+				{"audit", audit, tt.wantAudit},
+			} {
+				if !reflect.DeepEqual(c.got, c.want) {
+					t.Errorf("%s = %v, want %v", c.what, c.got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDropRowsKeepsConflictCount(t *testing.T) {
+	pb := testPreparedBatch()
+	pb.dropRows([]uint64{1}, "id", 3)
+	want := batchStats{Fetched: 4, Converted: 1, Failed: 2, Terminal: 1}
+	if pb.Stats != want {
+		t.Errorf("stats = %+v, want %+v", pb.Stats, want)
+	}
+}
+
+func TestPreparedBatchClone(t *testing.T) {
+	pb := testPreparedBatch()
+	c := pb.clone()
+	c.dropConflicts([]uint64{1, 2}, "id", 3)
+	orig := testPreparedBatch()
+	if !reflect.DeepEqual(pb, orig) {
+		t.Errorf("dropping from the clone changed the original:\n%+v\nwant\n%+v", pb, orig)
+	}
+}
+
+func TestIsLockError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "deadlock", err: &mysqldrv.MySQLError{Number: 1213}, want: true},
+		{name: "lock wait timeout", err: &mysqldrv.MySQLError{Number: 1205}, want: true},
+		{name: "wrapped", err: fmt.Errorf("batch: %w", &mysqldrv.MySQLError{Number: 1213}), want: true},
+		{name: "other mysql error", err: &mysqldrv.MySQLError{Number: 1054}, want: false},
+		{name: "plain error", err: errors.New("Deadlock found"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLockError(tt.err); got != tt.want {
+				t.Errorf("isLockError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ---------- CLI ----------
+
+// run-once / recompute 的結束碼
+const (
+	exitOK            = 0
+	exitSetupError    = 1 // 設定、連線、schema 檢查失敗
+	exitTableError    = 2 // 處理過程中有 SQL 錯誤
+	exitRecordsFailed = 3 // 跑完了，但仍有資料換算失敗（status=2）
+	exitUsage         = 64
+	exitInterrupted   = 130 // 收到 SIGINT/SIGTERM，做完目前批次後提前結束
+)
+
+const cliUsage = `usage: twacc [command] [flags]
+
+commands:
+  daemon      持續輪詢所有表（預設，不帶 command 時即為 daemon）
+  run-once    把所有表的 status=2 處理完一輪後結束
+  recompute   重算指定 id：recompute -table acc_cashbook -id 123,456 [-force]
+  explain     印出單筆的計算過程（不寫回）：explain -table acc_expenses -id 8812
+  requeue     把失敗次數用完（retry.terminal_status）的資料改回 status=2：requeue -table acc_expenses [-id 8812]
+  undo        依稽核紀錄還原某次執行寫入的值：undo -run 20240106T101500-3fa2c1 [-table acc_expenses] [-keep-status]
+              daemon 每張表的每一輪各有自己的 run_id（見 log 的 run_id），一次只還原一輪；
+              status 會改回 2，daemon 下一輪會重新換算，不想重算時加 -keep-status
+
+run-once / recompute 可加 -dry-run：完整撈取與計算但不寫回，把每筆差異寫到 -diff-out（CSV 或 JSONL）
+
+收到 SIGINT/SIGTERM 時會做完（或 rollback）目前批次的寫回，印出摘要後結束
+
+exit codes (run-once / recompute / undo):
+  0 全部成功  1 啟動失敗  2 處理時有 SQL 錯誤  3 仍有資料換算失敗（undo：有欄位因衝突未還原）  130 被中斷
+`
+
+func runCLI(args []string) int {
+	cmd := "daemon"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	switch cmd {
+	case "daemon":
+		return cmdDaemon(ctx, args)
+	case "run-once":
+		return cmdRunOnce(ctx, args)
+	case "recompute":
+		return cmdRecompute(ctx, args)
+	case "explain":
+		return cmdExplain(ctx, args)
+	case "requeue":
+		return cmdRequeue(ctx, args)
+	case "undo":
+		return cmdUndo(ctx, args)
+	case "help":
+		fmt.Print(cliUsage)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, cliUsage)
+		return exitUsage
+	}
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath(), "config file path (env "+envPrefix+"_CONFIG)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), cliUsage+"\nflags for "+name+":\n")
+		fs.PrintDefaults()
+	}
+	return fs, configPath
+}
+
+// run-once / recompute 共用的 dry-run 參數
+type dryRunFlags struct {
+	enabled bool
+	out     string
+	format  string
+}
+
+func addDryRunFlags(fs *flag.FlagSet) *dryRunFlags {
+	d := &dryRunFlags{}
+	fs.BoolVar(&d.enabled, "dry-run", false, "compute only, write a per-row diff instead of updating")
+	fs.StringVar(&d.out, "diff-out", "-", "dry-run diff output path (- = stdout)")
+	fs.StringVar(&d.format, "diff-format", "", "dry-run diff format: csv or jsonl (default by -diff-out extension, else jsonl)")
+	return d
+}
+
+// 開啟 diff 輸出；回傳的 close 需在結束前呼叫
+func (d *dryRunFlags) apply(env *recomputeEnv) (func() error, error) {
+	if !d.enabled {
+		return func() error { return nil }, nil
+	}
+	w, err := newDiffWriter(d.out, d.format)
+	if err != nil {
+		return nil, err
+	}
+	env.DryRun, env.Diff = true, w
+	env.Logger.Info("dry-run enabled", "diff_out", d.out)
+	return w.Close, nil
+}
+
+func setupEnv(ctx context.Context, configPath string) (*recomputeEnv, int) {
+	env, err := newRecomputeEnv(ctx, configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitSetupError
+	}
+	return env, exitOK
+}
+
+// daemon 同一張表兩輪之間的間隔：有資料轉換成功（或轉為 terminal_status）就馬上再排隊；
+// 沒有進展時等 daemonIdleDelay，出錯時至少等 daemonErrorDelay，避免一直重撈同樣失敗的資料
+const (
+	daemonIdleDelay  = 30 * time.Second
+	daemonErrorDelay = 10 * time.Second
+)
+
+// daemon：原本的無限輪詢
+func cmdDaemon(ctx context.Context, args []string) int {
+	fs, configPath := newFlagSet("daemon")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	env, code := setupEnv(ctx, *configPath)
+	if env == nil {
+		return code
+	}
+	env.Health = newHealthState(TableOrder)
+	if env.Cfg.HTTP.Addr != "" {
+		srv := startHTTPServer(env)
+		defer func() {
+			sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = srv.Shutdown(sctx)
+		}()
+	}
+
+	// 每張表各自輪詢，跑完一輪就重新排隊等 worker，不等其他表跑完
+	var mu sync.Mutex
+	total := batchStats{}
+	passes := 0 // 各表輪數加總
+	sem := make(chan struct{}, env.Cfg.Workers)
+	var wg sync.WaitGroup
+	for _, tbl := range TableOrder {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pollTable(ctx, env, tbl, sem, func(res tableResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				total.add(res.batchStats)
+				passes++
+			})
+		}()
+	}
+	wg.Wait()
+
+	summary := fmt.Sprintf("[daemon] shutdown passes=%d fetched=%d converted=%d failed=%d terminal=%d missing=%d conflicts=%d",
+		passes, total.Fetched, total.Converted, total.Failed, total.Terminal, total.Missing, total.Conflicts)
+	env.Logger.Info("shutdown", "cmd", "daemon", "passes", passes, "fetched", total.Fetched, "converted", total.Converted,
+		"failed", total.Failed, "terminal", total.Terminal, "missing", total.Missing, "conflicts", total.Conflicts)
+	fmt.Println(summary)
+	return exitOK
+}
+
+// daemon 單表的輪詢迴圈：每一輪有自己的 run_id 與 heartbeat，跑完依進展決定多久後再排隊；
+// sem 為所有表共用的 worker 數上限。單表 panic 只記為該輪的錯誤。
+func pollTable(ctx context.Context, env *recomputeEnv, table string, sem chan struct{}, onPass func(tableResult)) {
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		run := env.newRun()
+		env.Health.tableStart(table, run.RunID)
+		res := handleTableSafe(ctx, run, table)
+		env.Health.tableDone(table, res.Err)
+		if env.Cfg.HTTP.Addr != "" {
+			refreshPending(ctx, run, table)
+		}
+		<-sem
+		onPass(res)
+		if ctx.Err() != nil {
+			return
+		}
+		env.Health.passDone()
+		markHeartbeat()
+
+		// 只有真的寫成 status=1 或 terminal_status 才算有進展；一直失敗的資料仍是 status=2，不能讓下一輪馬上開始
+		var delay time.Duration
+		switch {
+		case res.Err != nil:
+			run.Logger.Warn("heartbeat", logKeyTable, table, "status", "error", "err", res.Err)
+			delay = daemonErrorDelay
+		case res.Converted > 0 || res.Terminal > 0:
+			run.Logger.Info("heartbeat", logKeyTable, table, "status", "pending")
+		default:
+			run.Logger.Info("heartbeat", logKeyTable, table, "status", "idle")
+			delay = daemonIdleDelay
+		}
+		if !sleepCtx(ctx, delay) {
+			return
+		}
+	}
+}
+
+// 等 d 或直到 ctx 取消；回傳 false 代表已取消
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// run-once：每張表處理到沒有 status=2 為止（失敗的資料 keyset 往後推，不會重複處理），然後結束
+func cmdRunOnce(ctx context.Context, args []string) int {
+	fs, configPath := newFlagSet("run-once")
+	dry := addDryRunFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	env, code := setupEnv(ctx, *configPath)
+	if env == nil {
+		return code
+	}
+	closeDiff, err := dry.apply(env)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSetupError
+	}
+
+	total := batchStats{}
+	var errTables []string
+	results := runPass(ctx, env, TableOrder, func(tbl string, res tableResult) {
+		env.Logger.Info("table done", "cmd", "run-once", logKeyTable, tbl, "batches", res.Batches, "fetched", res.Fetched,
+			"converted", res.Converted, "failed", res.Failed, "terminal", res.Terminal, "missing", res.Missing, "conflicts", res.Conflicts, "err", res.Err)
+	})
+	for i, res := range results {
+		total.add(res.batchStats)
+		if res.Err != nil {
+			errTables = append(errTables, TableOrder[i])
+		}
+	}
+	return finish(ctx, env, "run-once", total, errTables, closeDiff)
+}
+
+// recompute：指定表與 id 重算；-force 時不限 status=2
+func cmdRecompute(ctx context.Context, args []string) int {
+	fs, configPath := newFlagSet("recompute")
+	table := fs.String("table", "", "table name, e.g. acc_cashbook")
+	idList := fs.String("id", "", "comma-separated ids, e.g. 123,456")
+	force := fs.Bool("force", false, "recompute even if status != 2")
+	dry := addDryRunFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	ids, err := parseIDList(*idList)
+	if err != nil || *table == "" || len(ids) == 0 {
+		if err == nil {
+			err = errors.New("-table and -id are required")
+		}
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		return exitUsage
+	}
+
+	env, code := setupEnv(ctx, *configPath)
+	if env == nil {
+		return code
+	}
+	mapping, sets, ok := tableMapping(*table)
+	if !ok || !containsString(TableOrder, *table) {
+		fmt.Fprintf(os.Stderr, "table %q is not mapped or is disabled\n", *table)
+		return exitUsage
+	}
+	closeDiff, err := dry.apply(env)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSetupError
+	}
+
+	env.Logger.Info("recompute", logKeyTable, *table, "ids", ids, "force", *force)
+	total := batchStats{}
+	var errTables []string
+	for start := 0; start < len(ids) && ctx.Err() == nil; start += env.Cfg.RecomputeBatchSize {
+		end := min(start+env.Cfg.RecomputeBatchSize, len(ids))
+		st, err := processBatch(ctx, env, *table, mapping, sets, ids[start:end], *force)
+		total.add(st)
+		if err != nil && len(errTables) == 0 {
+			errTables = append(errTables, *table)
+		}
+	}
+	return finish(ctx, env, "recompute", total, errTables, closeDiff)
+}
+
+// explain：追蹤單筆資料的辦公室、匯率、捨入與最終 update，印到 stdout
+func cmdExplain(ctx context.Context, args []string) int {
+	fs, configPath := newFlagSet("explain")
+	table := fs.String("table", "", "table name, e.g. acc_expenses")
+	id := fs.Uint64("id", 0, "record id")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *table == "" || *id == 0 {
+		fmt.Fprintln(os.Stderr, "-table and -id are required")
+		fs.Usage()
+		return exitUsage
+	}
+
+	env, code := setupEnv(ctx, *configPath)
+	if env == nil {
+		return code
+	}
+	if !containsString(TableOrder, *table) {
+		fmt.Fprintf(os.Stderr, "table %q is not mapped or is disabled\n", *table)
+		return exitUsage
+	}
+	if err := explainRecord(ctx, env, *table, *id, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitTableError
+	}
+	return exitOK
+}
+
+// requeue：terminal_status 的資料改回 status=2 並清除重試紀錄；不帶 -id 時處理整張表
+func cmdRequeue(ctx context.Context, args []string) int {
+	fs, configPath := newFlagSet("requeue")
+	table := fs.String("table", "", "table name, e.g. acc_expenses")
+	idList := fs.String("id", "", "comma-separated ids (default: every record in terminal status)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	ids, err := parseIDList(*idList)
+	if err != nil || *table == "" {
+		if err == nil {
+			err = errors.New("-table is required")
+		}
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		return exitUsage
+	}
+
+	env, code := setupEnv(ctx, *configPath)
+	if env == nil {
+		return code
+	}
+	mapping, _, ok := tableMapping(*table)
+	if !ok || !containsString(TableOrder, *table) {
+		fmt.Fprintf(os.Stderr, "table %q is not mapped or is disabled\n", *table)
+		return exitUsage
+	}
+	n, err := requeueRecords(ctx, env.DB, env.Cfg, *table, mapping.IDColumn, ids, env.Logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitTableError
+	}
+	fmt.Printf("[requeue] %s requeued=%d (status %d -> 2)\n", *table, n, env.Cfg.Retry.TerminalStatus)
+	return exitOK
+}
+
+// undo：把某次執行（run_id）寫入的值還原成寫入前的值；現值已被改過的資料不動，列出衝突
+func cmdUndo(ctx context.Context, args []string) int {
+	fs, configPath := newFlagSet("undo")
+	runID := fs.String("run", "", "run_id to undo (see run_id in the log or acc_recompute_audit)")
+	table := fs.String("table", "", "only undo this table (default: every table the run changed)")
+	keepStatus := fs.Bool("keep-status", false, "leave status / recompute_info as they are (restoring status=2 makes the daemon recompute the record)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *runID == "" {
+		fmt.Fprintln(os.Stderr, "-run is required")
+		fs.Usage()
+		return exitUsage
+	}
+
+	env, code := setupEnv(ctx, *configPath)
+	if env == nil {
+		return code
+	}
+	res, err := undoRun(ctx, env, *runID, *table, *keepStatus)
+	for _, c := range res.Conflicts {
+		current := nullText(c.Current)
+		if c.Missing {
+			current = "(record not found)"
+		}
+		fmt.Printf("[undo] conflict %s id=%d column=%s current=%s written_by_run=%s\n", c.Table, c.ID, c.Column, current, nullText(c.Want))
+	}
+	summary := fmt.Sprintf("[undo] run=%s records=%d restored=%d partial=%d skipped=%d conflicts=%d",
+		*runID, res.Records, res.Restored, res.Partial, res.Skipped, len(res.Conflicts))
+	if ctx.Err() != nil {
+		summary += " interrupted=true"
+	}
+	fmt.Println(summary)
+	switch {
+	case err != nil:
+		env.Logger.Error("undo error", "undo_run_id", *runID, "err", err)
+		fmt.Fprintln(os.Stderr, err)
+		return exitTableError
+	case ctx.Err() != nil:
+		return exitInterrupted
+	case res.Records == 0:
+		fmt.Fprintf(os.Stderr, "no audit rows for run %s (is audit enabled?)\n", *runID)
+		return exitOK
+	case len(res.Conflicts) > 0:
+		return exitRecordsFailed
+	}
+	return exitOK
+}
+
+// 印出摘要並決定結束碼；dry-run 時摘要寫到 stderr，避免混進 stdout 的 diff
+func finish(ctx context.Context, env *recomputeEnv, cmd string, total batchStats, errTables []string, closeDiff func() error) int {
+	if err := closeDiff(); err != nil {
+		env.Logger.Error("close diff error", "cmd", cmd, "err", err)
+		errTables = append(errTables, "diff-output")
+	}
+	interrupted := ctx.Err() != nil
+	summary := fmt.Sprintf("[%s] done fetched=%d converted=%d failed=%d terminal=%d missing=%d conflicts=%d error_tables=%v",
+		cmd, total.Fetched, total.Converted, total.Failed, total.Terminal, total.Missing, total.Conflicts, errTables)
+	if interrupted {
+		summary += " interrupted=true"
+	}
+	out := os.Stdout
+	if env.DryRun {
+		summary = fmt.Sprintf("%s dry_run=true changed=%d", summary, total.Changed)
+		out = os.Stderr
+	}
+	env.Logger.Info("done", "cmd", cmd, "fetched", total.Fetched, "converted", total.Converted, "failed", total.Failed,
+		"terminal", total.Terminal, "missing", total.Missing, "conflicts", total.Conflicts, "changed", total.Changed, "dry_run", env.DryRun, "error_tables", errTables,
+		"interrupted", interrupted)
+	fmt.Fprintln(out, summary)
+	switch {
+	case interrupted:
+		return exitInterrupted
+	case len(errTables) > 0:
+		return exitTableError
+	case total.Failed > 0:
+		return exitRecordsFailed
+	default:
+		return exitOK
+	}
+}
+
+func parseIDList(s string) ([]uint64, error) {
+	ids := []uint64{}
+	seen := map[uint64]bool{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad id %q", p)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIDList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []uint64
+		wantErr string
+	}{
+		{in: "", want: []uint64{}},
+		{in: "123", want: []uint64{123}},
+		{in: " 3, 1 ,2 ", want: []uint64{3, 1, 2}},
+		{in: "5,,5,6,", want: []uint64{5, 6}},
+		{in: "18446744073709551615", want: []uint64{18446744073709551615}},
+		{in: "1,abc", wantErr: `bad id "abc"`},
+		{in: "-1", wantErr: `bad id "-1"`},
+		{in: "1 2", wantErr: `bad id "1 2"`},
+	}
+	for _, tt := range tests {
+		got, err := parseIDList(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseIDList(%q) err = %v, want containing %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIDList(%q) unexpected err: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIDList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+// ---------- dry-run diff ----------
+
+// 一筆欄位變更；OldValue/NewValue 為 nil 代表 NULL
+type diffRow struct {
+	Table        string  `json:"table"`
+	ID           uint64  `json:"id"`
+	Column       string  `json:"column"`
+	OldValue     *string `json:"old_value"`
+	NewValue     *string `json:"new_value"`
+	OldStatus    int     `json:"old_status"`
+	NewStatus    int     `json:"new_status"`
+	OldRecompute *string `json:"old_recompute_info"`
+	NewRecompute *string `json:"new_recompute_info"`
+}
+
+// 比對 computeUpdateCached 的結果與撈出來的現值，回傳有變動的欄位。
+// 欄位都沒變、只有 status / recompute_info 變時，輸出一筆 column=status。
+func diffUpdate(table string, rec recordRow, upd map[string]any) []diffRow {
+	newStatus, _ := upd["status"].(int)
+	newInfo := valueString(upd["recompute_info"])
+	oldInfo := nullStringPtr(rec.RecomputeInfo)
+	base := diffRow{
+		Table: table, ID: rec.ID,
+		OldStatus: rec.Status, NewStatus: newStatus,
+		OldRecompute: oldInfo, NewRecompute: newInfo,
+	}
+
+	cols := make([]string, 0, len(upd))
+	for c := range upd {
+		if c != "status" && c != "recompute_info" {
+			cols = append(cols, c)
+		}
+	}
+	sort.Strings(cols)
+
+	out := []diffRow{}
+	for _, c := range cols {
+		var oldVal *string
+		changed := true
+		if amt, ok := rec.Amounts[c]; ok {
+			if amt.Valid {
+				v := amt.Decimal.String()
+				oldVal = &v
+			}
+			if nd, ok := upd[c].(decimal.Decimal); ok && amt.Valid {
+				changed = !amt.Decimal.Equal(nd)
+			}
+		} else if off, ok := rec.Offices[c]; ok {
+			oldVal = nullStringPtr(off)
+			changed = !equalStringPtr(oldVal, valueString(upd[c]))
+		}
+		if !changed {
+			continue
+		}
+		r := base
+		r.Column = c
+		r.OldValue = oldVal
+		r.NewValue = valueString(upd[c])
+		out = append(out, r)
+	}
+	if len(out) == 0 && (rec.Status != newStatus || !equalStringPtr(oldInfo, newInfo)) {
+		r := base
+		r.Column = "status"
+		o, n := strconv.Itoa(rec.Status), strconv.Itoa(newStatus)
+		r.OldValue, r.NewValue = &o, &n
+		out = append(out, r)
+	}
+	return out
+}
+
+func valueString(v any) *string {
+	var s string
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case decimal.Decimal:
+		s = x.String()
+	case decimal.NullDecimal:
+		if !x.Valid {
+			return nil
+		}
+		s = x.Decimal.String()
+	case sql.NullString:
+		return nullStringPtr(x)
+	case string:
+		s = x
+	default:
+		s = fmt.Sprint(x)
+	}
+	return &s
+}
+
+func nullStringPtr(ns sql.NullString) *string {
+	if !ns.Valid {
+		return nil
+	}
+	s := ns.String
+	return &s
+}
+
+func equalStringPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// ---------- diff writers ----------
+
+type diffWriter interface {
+	Write(rows []diffRow) error
+	Close() error
+}
+
+// path 為 "-" 時寫到 stdout；format 空字串時依副檔名判斷（.csv 以外皆為 jsonl）
+func newDiffWriter(path, format string) (diffWriter, error) {
+	var w io.WriteCloser = nopCloser{os.Stdout}
+	if path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	if format == "" {
+		format = "jsonl"
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			format = "csv"
+		}
+	}
+	switch strings.ToLower(format) {
+	case "csv":
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"table", "id", "column", "old_value", "new_value",
+			"old_status", "new_status", "old_recompute_info", "new_recompute_info"})
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		return &csvDiffWriter{w: w, cw: cw}, nil
+	case "jsonl":
+		bw := bufio.NewWriter(w)
+		return &jsonlDiffWriter{w: w, bw: bw, enc: json.NewEncoder(bw)}, nil
+	default:
+		w.Close()
+		return nil, fmt.Errorf("unknown diff format %q (want csv or jsonl)", format)
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+type csvDiffWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	cw *csv.Writer
+}
+
+func (d *csvDiffWriter) Write(rows []diffRow) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	opt := func(p *string) string {
+		if p == nil {
+			return "NULL"
+		}
+		return *p
+	}
+	for _, r := range rows {
+		err := d.cw.Write([]string{r.Table, strconv.FormatUint(r.ID, 10), r.Column, opt(r.OldValue), opt(r.NewValue),
+			strconv.Itoa(r.OldStatus), strconv.Itoa(r.NewStatus), opt(r.OldRecompute), opt(r.NewRecompute)})
+		if err != nil {
+			return err
+		}
+	}
+	d.cw.Flush()
+	return d.cw.Error()
+}
+
+func (d *csvDiffWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cw.Flush()
+	if err := d.cw.Error(); err != nil {
+		d.w.Close()
+		return err
+	}
+	return d.w.Close()
+}
+
+type jsonlDiffWriter struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+func (d *jsonlDiffWriter) Write(rows []diffRow) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range rows {
+		if err := d.enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *jsonlDiffWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.bw.Flush(); err != nil {
+		d.w.Close()
+		return err
+	}
+	return d.w.Close()
+}
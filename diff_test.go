@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func sp(s string) *string { return &s }
+
+func nd(s string) decimal.NullDecimal {
+	return decimal.NewNullDecimal(decimal.RequireFromString(s))
+}
+
+func TestDiffUpdate(t *testing.T) {
+	rec := recordRow{
+		ID:            42,
+		Status:        2,
+		RecomputeInfo: sql.NullString{String: "no rate", Valid: true},
+		Amounts: map[string]decimal.NullDecimal{
+			"amount_usdt": nd("1.20"),
+			"amount_cny":  {},
+		},
+		Offices: map[string]sql.NullString{
+			"main_office": {String: "Manila", Valid: true},
+			"sub_office":  {},
+		},
+	}
+	base := diffRow{Table: "acc_expenses", ID: 42, OldStatus: 2, NewStatus: 1, OldRecompute: sp("no rate")}
+
+	tests := []struct {
+		name string
+		upd  map[string]any
+		want []diffRow
+	}{
+		{
+			name: "changed columns sorted, equal decimals skipped",
+			upd: map[string]any{
+				"status": 1, "recompute_info": nil,
+				"amount_usdt": decimal.RequireFromString("1.2"),
+				"amount_cny":  decimal.RequireFromString("8.64"),
+				"main_office": "Manila",
+				"sub_office":  "Makati",
+			},
+			want: []diffRow{
+				base.with("amount_cny", nil, sp("8.64")),
+				base.with("sub_office", nil, sp("Makati")),
+			},
+		},
+		{
+			name: "amount changed",
+			upd: map[string]any{
+				"status": 1, "recompute_info": nil,
+				"amount_usdt": decimal.RequireFromString("1.21"),
+			},
+			want: []diffRow{
+				base.with("amount_usdt", sp("1.2"), sp("1.21")),
+			},
+		},
+		{
+			name: "only status changes",
+			upd: map[string]any{
+				"status": 1, "recompute_info": nil,
+				"amount_usdt": decimal.RequireFromString("1.2"),
+				"main_office": "Manila",
+			},
+			want: []diffRow{
+				base.with("status", sp("2"), sp("1")),
+			},
+		},
+		{
+			name: "only recompute_info changes",
+			upd:  map[string]any{"status": 2, "recompute_info": "office not found by sub_code"},
+			want: []diffRow{{
+				Table: "acc_expenses", ID: 42, Column: "status", OldValue: sp("2"), NewValue: sp("2"),
+				OldStatus: 2, NewStatus: 2, OldRecompute: sp("no rate"), NewRecompute: sp("office not found by sub_code"),
+			}},
+		},
+		{
+			name: "nothing changes",
+			upd:  map[string]any{"status": 2, "recompute_info": "no rate", "amount_usdt": decimal.RequireFromString("1.200")},
+			want: []diffRow{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffUpdate("acc_expenses", rec, tt.upd)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffUpdate =\n%s\nwant\n%s", fmtDiffRows(got), fmtDiffRows(tt.want))
+			}
+		})
+	}
+}
+
+func (r diffRow) with(col string, oldVal, newVal *string) diffRow {
+	r.Column, r.OldValue, r.NewValue = col, oldVal, newVal
+	return r
+}
+
+func fmtDiffRows(rows []diffRow) string {
+	s := ""
+	for _, r := range rows {
+		s += r.Column + " " + nullText(r.OldValue) + " -> " + nullText(r.NewValue) +
+			" info " + nullText(r.OldRecompute) + " -> " + nullText(r.NewRecompute) + "\n"
+	}
+	return s
+}
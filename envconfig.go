@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ---------- env-var overrides ----------
+
+// 環境變數前綴：TWACC_<yaml 路徑，以 _ 連接並轉大寫>，例如
+//
+//	TWACC_MODE=production
+//	TWACC_RECOMPUTE_BATCH_SIZE=500
+//	TWACC_RATES_LOOKBACK_DAYS=3
+//	TWACC_RATES_PIVOTS=CNY,USDT       （字串清單以逗號分隔）
+//	TWACC_RETRY_BASE_DELAY=30s        （時間長度用 Go duration 格式）
+//	TWACC_DATABASE_DSN=...            （套用到 mode 選出的環境，見 loadConfig）
+//	TWACC_ROUNDING_CURRENCIES='{USDT: {places: 4}}'        （map 與 struct 清單用 YAML / JSON，整個取代設定檔的值）
+//	TWACC_TABLES='[{"table": "acc_cashbook"}, {"table": "acc_expenses"}]'
+const envPrefix = "TWACC"
+
+// 未指定 -config 時的設定檔路徑
+func defaultConfigPath() string {
+	if p := os.Getenv(envPrefix + "_CONFIG"); p != "" {
+		return p
+	}
+	return "config.yaml"
+}
+
+// 依 yaml tag 走訪設定結構，有對應環境變數的欄位就覆蓋。
+// struct 欄位往下展開（TWACC_RETRY_ENABLED）；map 與 struct 清單（例如 database、tables、rates.static）以 YAML 解析整個值。
+func applyEnvOverrides(v any, prefix string) error {
+	return overrideStruct(reflect.ValueOf(v).Elem(), prefix)
+}
+
+func overrideStruct(rv reflect.Value, prefix string) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		fv := rv.Field(i)
+		if strings.Contains(opts, "inline") {
+			if err := overrideStruct(fv, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		key := prefix + "_" + strings.ToUpper(name)
+		if f.Type.Kind() == reflect.Struct {
+			if err := overrideStruct(fv, key); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, raw); err != nil {
+			return fmt.Errorf("env %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func setFromEnv(fv reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.Pointer:
+		nv := reflect.New(fv.Type().Elem())
+		if err := setFromEnv(nv.Elem(), raw); err != nil {
+			return err
+		}
+		fv.Set(nv)
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(n)
+	case reflect.Map:
+		return setFromYAML(fv, raw)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return setFromYAML(fv, raw)
+		}
+		parts := []string{}
+		for _, p := range strings.Split(raw, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				parts = append(parts, p)
+			}
+		}
+		fv.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+// YAML（含 JSON）整個取代欄位值，不與設定檔合併
+func setFromYAML(fv reflect.Value, raw string) error {
+	nv := reflect.New(fv.Type())
+	if err := yaml.Unmarshal([]byte(raw), nv.Interface()); err != nil {
+		return fmt.Errorf("parse %s as YAML/JSON: %w", fv.Type(), err)
+	}
+	fv.Set(nv.Elem())
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type envTestInner struct {
+	Depth int `yaml:"depth"`
+}
+
+type envTestConfig struct {
+	RoundingRule `yaml:",inline"`
+	Name         string         `yaml:"name"`
+	Count        int            `yaml:"count"`
+	Ratio        float64        `yaml:"ratio"`
+	On           bool           `yaml:"on"`
+	Wait         time.Duration  `yaml:"wait"`
+	Limit        *int           `yaml:"limit"`
+	List         []string       `yaml:"list"`
+	Nums         []int          `yaml:"nums"`
+	Inner        envTestInner   `yaml:"inner"`
+	M            map[string]int `yaml:"m"`
+	Skip         string         `yaml:"-"`
+	NoTag        string
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	limit := 7
+	base := func() envTestConfig {
+		return envTestConfig{Name: "file", Count: 1, List: []string{"a"}, M: map[string]int{"x": 1, "y": 2}, Skip: "keep"}
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    func(c *envTestConfig)
+		wantErr string
+	}{
+		{name: "no env keeps file values", want: func(c *envTestConfig) {}},
+		{
+			name: "scalars",
+			env: map[string]string{
+				"T_NAME": " env ", "T_COUNT": "42", "T_RATIO": "0.5", "T_ON": "true",
+				"T_WAIT": "1m30s", "T_LIMIT": "7", "T_NOTAG": "x",
+			},
+			want: func(c *envTestConfig) {
+				c.Name, c.Count, c.Ratio, c.On = "env", 42, 0.5, true
+				c.Wait, c.Limit, c.NoTag = 90*time.Second, &limit, "x"
+			},
+		},
+		{
+			name: "nested and inline",
+			env:  map[string]string{"T_INNER_DEPTH": "3", "T_MODE": "down", "T_PLACES": "4"},
+			want: func(c *envTestConfig) {
+				c.Inner.Depth, c.Mode, c.Places = 3, "down", places(4)
+			},
+		},
+		{
+			name: "string list is comma separated",
+			env:  map[string]string{"T_LIST": " CNY, ,USDT "},
+			want: func(c *envTestConfig) { c.List = []string{"CNY", "USDT"} },
+		},
+		{
+			name: "other lists and maps replace the file value",
+			env:  map[string]string{"T_NUMS": "[1, 2]", "T_M": `{"z": 3}`},
+			want: func(c *envTestConfig) { c.Nums, c.M = []int{1, 2}, map[string]int{"z": 3} },
+		},
+		{
+			name: "yaml-tag dash is ignored",
+			env:  map[string]string{"T_SKIP": "env"},
+			want: func(c *envTestConfig) {},
+		},
+		{name: "bad int", env: map[string]string{"T_COUNT": "many"}, wantErr: "env T_COUNT"},
+		{name: "bad duration", env: map[string]string{"T_WAIT": "30"}, wantErr: "env T_WAIT"},
+		{name: "bad map", env: map[string]string{"T_M": "[1"}, wantErr: "env T_M: parse map[string]int as YAML/JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			got := base()
+			err := applyEnvOverrides(&got, "T")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			want := base()
+			tt.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverridesConfig(t *testing.T) {
+	t.Setenv("TWACC_RETRY_ENABLED", "true")
+	t.Setenv("TWACC_RATES_PIVOTS", "CNY,USDT")
+	t.Setenv("TWACC_ROUNDING_CURRENCIES", "{usdt: {places: 4}}")
+	cfg := Config{Rounding: RoundingConfig{Currencies: map[string]RoundingRule{"CNY": {Mode: roundDown}}}}
+	if err := applyEnvOverrides(&cfg, envPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Retry.Enabled {
+		t.Error("retry.enabled not overridden")
+	}
+	if !reflect.DeepEqual(cfg.Rates.Pivots, []string{"CNY", "USDT"}) {
+		t.Errorf("rates.pivots = %v", cfg.Rates.Pivots)
+	}
+	want := map[string]RoundingRule{"usdt": {Places: places(4)}}
+	if !reflect.DeepEqual(cfg.Rounding.Currencies, want) {
+		t.Errorf("rounding.currencies = %+v, want %+v", cfg.Rounding.Currencies, want)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ---------- explain：單筆計算追蹤 ----------
+
+// computeUpdateCached 的計算過程；傳 nil 時不記錄（一般批次處理）
+type computeTrace struct {
+	OfficePath   string // officePathSite / officePathSub，空字串代表沒有可用的 code
+	Office       officeInfo
+	OfficeReason string
+	Sets         []*setTrace
+}
+
+// 一組 AmountFieldSet 的換算過程
+type setTrace struct {
+	Set     AmountFieldSet
+	Base    decimal.NullDecimal
+	Skipped string // 未換算的原因（base NULL、office_only…）
+	Lookups []rateLookup
+	Outputs []outputTrace
+	Written bool // 換算成功並寫入 update
+}
+
+type rateLookup struct {
+	Date     time.Time
+	From, To string
+	Hit      rateHit
+	Err      error
+}
+
+// 一個換算後欄位；Rule 為 nil 代表與原幣相同，直接沿用 base 不捨入
+type outputTrace struct {
+	Column string
+	Target string
+	Rate   decimal.Decimal
+	Raw    decimal.Decimal
+	Rule   *RoundingRule
+	Value  decimal.Decimal
+}
+
+func (t *computeTrace) addSet(set AmountFieldSet, base decimal.NullDecimal) *setTrace {
+	if t == nil {
+		return nil
+	}
+	st := &setTrace{Set: set, Base: base}
+	t.Sets = append(t.Sets, st)
+	return st
+}
+
+func (s *setTrace) skip(reason string) {
+	if s != nil {
+		s.Skipped = reason
+	}
+}
+
+func (s *setTrace) addLookup(date time.Time, from, to string, hit rateHit, err error) {
+	if s != nil {
+		s.Lookups = append(s.Lookups, rateLookup{Date: date, From: from, To: to, Hit: hit, Err: err})
+	}
+}
+
+func (s *setTrace) addOutput(o outputTrace) {
+	if s != nil {
+		s.Outputs = append(s.Outputs, o)
+	}
+}
+
+func (s *setTrace) written() {
+	if s != nil {
+		s.Written = true
+	}
+}
+
+// 用與 processBatch 相同的預撈與計算流程處理一筆資料（不限 status、不寫回），把過程印到 w
+func explainRecord(ctx context.Context, env *recomputeEnv, table string, id uint64, w io.Writer) error {
+	mapping, sets, ok := tableMapping(table)
+	if !ok {
+		return fmt.Errorf("table %q is not mapped or is disabled", table)
+	}
+	recMap, err := fetchRecordsBatch(ctx, env.DB, table, []uint64{id}, mapping, sets, false)
+	if err != nil {
+		return fmt.Errorf("fetch record: %w", err)
+	}
+	rec, ok := recMap[id]
+	if !ok {
+		return fmt.Errorf("%s: %s=%d not found", table, mapping.IDColumn, id)
+	}
+	siteMap, subMap, err := prefetchOffices(ctx, env.DB, recMap)
+	if err != nil {
+		return fmt.Errorf("prefetch offices: %w", err)
+	}
+	rc, err := prefetchRates(ctx, env.Rates, recMap, env.Cfg.Rates)
+	if err != nil {
+		return fmt.Errorf("prefetch rates: %w", err)
+	}
+
+	trace := &computeTrace{}
+	upd, _ := computeUpdateCached(mapping, sets, rec, siteMap, subMap, rc, env.Cfg.Rounding, table, env.Logger, trace)
+
+	fmt.Fprintf(w, "record %s %s=%d\n", table, mapping.IDColumn, id)
+	writeRawRow(w, rec, sets)
+	writeOfficeTrace(w, mapping, rec, trace)
+	writeSetTraces(w, mapping, trace, env.Cfg.Rates)
+	writeUpdate(w, upd)
+	if retry := env.Cfg.Retry; retry.Enabled {
+		attempts, err := loadRetryAttempts(ctx, env.DB, table, []uint64{id})
+		if err != nil {
+			return fmt.Errorf("load retry attempts: %w", err)
+		}
+		fmt.Fprintf(w, "\nretry:\n  attempts %d (max_attempts=%d)\n", attempts[id], retry.MaxAttempts)
+		if upd["status"] == 2 && retry.exhausted(attempts[id]+1) {
+			fmt.Fprintf(w, "  this failure would move the record to terminal status=%d\n", retry.TerminalStatus)
+		}
+	}
+	switch {
+	case rec.Status == env.Cfg.Retry.TerminalStatus:
+		fmt.Fprintf(w, "\nnote: current status=%d is the terminal failure status, use requeue to put it back into polling\n", rec.Status)
+	case rec.Status != 2:
+		fmt.Fprintf(w, "\nnote: current status=%d, the polling loop only picks up status=2 (use recompute -force to rewrite)\n", rec.Status)
+	}
+	return nil
+}
+
+func writeRawRow(w io.Writer, rec recordRow, sets []AmountFieldSet) {
+	fmt.Fprintln(w, "\nraw row:")
+	fmt.Fprintf(w, "  %-22s %d\n", "status", rec.Status)
+	fmt.Fprintf(w, "  %-22s %s\n", "recompute_info", nullText(nullStringPtr(rec.RecomputeInfo)))
+	fmt.Fprintf(w, "  %-22s %s\n", "currency", nullText(nullStringPtr(rec.Currency)))
+	entry := "NULL"
+	if rec.EntryDate.Valid {
+		entry = rec.EntryDate.Time.Format("2006-01-02")
+	}
+	fmt.Fprintf(w, "  %-22s %s\n", "entry_date", entry)
+	fmt.Fprintf(w, "  %-22s %s\n", "sub_code", emptyText(rec.SubCode))
+	fmt.Fprintf(w, "  %-22s %s\n", "site_code", emptyText(rec.SiteCode))
+	for _, s := range sets {
+		for _, c := range []string{s.Base, s.Usdt, s.Cny} {
+			fmt.Fprintf(w, "  %-22s %s\n", c, nullText(valueString(rec.Amounts[c])))
+		}
+	}
+	for _, c := range sortedKeys(rec.Offices) {
+		fmt.Fprintf(w, "  %-22s %s\n", c, nullText(nullStringPtr(rec.Offices[c])))
+	}
+}
+
+func writeOfficeTrace(w io.Writer, mapping FieldMapping, rec recordRow, t *computeTrace) {
+	fmt.Fprintln(w, "\noffice:")
+	switch t.OfficePath {
+	case officePathSite:
+		fmt.Fprintf(w, "  path      site_code=%s (data_office_site -> data_office_sub -> data_office_main)\n", rec.SiteCode)
+	case officePathSub:
+		fmt.Fprintf(w, "  path      sub_code=%s (data_office_sub -> data_office_main)\n", rec.SubCode)
+	default:
+		fmt.Fprintf(w, "  path      none (site_code column=%s value=%s, sub_code column=%s value=%s)\n",
+			emptyText(mapping.SiteCode), emptyText(rec.SiteCode), emptyText(mapping.SubCode), emptyText(rec.SubCode))
+		return
+	}
+	if t.OfficeReason != "" {
+		fmt.Fprintf(w, "  result    NOT FOUND: %s\n", t.OfficeReason)
+		return
+	}
+	o := t.Office
+	if o.SiteID != 0 {
+		fmt.Fprintf(w, "  site      data_office_site#%d site_code=%s\n", o.SiteID, o.SiteCode)
+	}
+	fmt.Fprintf(w, "  sub       data_office_sub#%d sub_code=%s name=%s\n", o.SubID, o.SubCode, o.SubOffice)
+	fmt.Fprintf(w, "  main      data_office_main#%d main_code=%s name=%s\n", o.MainID, o.MainCode, o.MainOffice)
+}
+
+func writeSetTraces(w io.Writer, mapping FieldMapping, t *computeTrace, opts RateConfig) {
+	fmt.Fprintln(w, "\namount sets:")
+	if mapping.OfficeOnly {
+		fmt.Fprintln(w, "  office_only table, no amount conversion")
+		return
+	}
+	fmt.Fprintf(w, "  rate lookup: lookback_days=%d resolve_order=%v pivots=%v\n",
+		opts.LookbackDays, opts.ResolveOrder, opts.Pivots)
+	for i, st := range t.Sets {
+		fmt.Fprintf(w, "  [%d] base=%s (%s) usdt=%s cny=%s\n", i, st.Set.Base, nullText(valueString(st.Base)), st.Set.Usdt, st.Set.Cny)
+		if st.Skipped != "" {
+			fmt.Fprintf(w, "      skipped: %s\n", st.Skipped)
+			continue
+		}
+		for _, l := range st.Lookups {
+			key := fmt.Sprintf("%s->%s @%s", l.From, l.To, l.Date.Format("2006-01-02"))
+			if l.Err != nil {
+				fmt.Fprintf(w, "      rate %s: NOT FOUND (%v)\n", key, l.Err)
+				continue
+			}
+			fmt.Fprintf(w, "      rate %s: %s (rate_date=%s direction=%s", key, l.Hit.Rate, l.Hit.Date, l.Hit.Direction)
+			if l.Hit.Path != "" {
+				fmt.Fprintf(w, " path=%s", l.Hit.Path)
+			}
+			fmt.Fprintln(w, ")")
+		}
+		for _, o := range st.Outputs {
+			if o.Rule == nil {
+				fmt.Fprintf(w, "      %s = %s (same currency, copied from base)\n", o.Column, o.Value)
+				continue
+			}
+			fmt.Fprintf(w, "      %s = %s x %s = %s, rounding %s -> %s\n", o.Column, st.Base.Decimal, o.Rate, o.Raw, o.Rule, o.Value)
+		}
+		if !st.Written {
+			fmt.Fprintln(w, "      not written: rate lookup failed")
+		}
+	}
+}
+
+func writeUpdate(w io.Writer, upd map[string]any) {
+	fmt.Fprintln(w, "\nupdate:")
+	for _, c := range sortedKeys(upd) {
+		fmt.Fprintf(w, "  %-22s %s\n", c, nullText(valueString(upd[c])))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func nullText(p *string) string {
+	if p == nil {
+		return "NULL"
+	}
+	return *p
+}
+
+func emptyText(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "(empty)"
+	}
+	return s
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------- /healthz, /readyz ----------
+
+// daemon 主迴圈的狀態，給 HTTP 端點讀
+type healthState struct {
+	mu       sync.Mutex
+	started  time.Time
+	lastTick time.Time // 最後一次處理完一個批次或一張表
+	lastPass time.Time // 最後一次有表跑完一輪
+	runID    string    // 最近開始的一輪
+	tables   map[string]*tableHealth
+}
+
+type tableHealth struct {
+	RunID       string     `json:"run_id,omitempty"` // 目前或最近一輪
+	LastRunAt   *time.Time `json:"last_run_at"`
+	LastError   string     `json:"last_error,omitempty"` // 最近一輪的錯誤；該表下一輪成功後清空
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+type healthReport struct {
+	Status     string                  `json:"status"`
+	Error      string                  `json:"error,omitempty"`
+	StartedAt  time.Time               `json:"started_at"`
+	LastTickAt *time.Time              `json:"last_tick_at"`
+	LastPassAt *time.Time              `json:"last_pass_at"`
+	RunID      string                  `json:"run_id"`
+	Tables     map[string]*tableHealth `json:"tables"`
+}
+
+func newHealthState(tables []string) *healthState {
+	h := &healthState{started: time.Now(), tables: map[string]*tableHealth{}}
+	for _, t := range tables {
+		h.tables[t] = &tableHealth{}
+	}
+	return h
+}
+
+// daemon 各表各自輪詢，每一輪有自己的 run_id
+func (h *healthState) tableStart(table, runID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runID = runID
+	th := h.tables[table]
+	if th == nil {
+		th = &tableHealth{}
+		h.tables[table] = th
+	}
+	th.RunID = runID
+}
+
+// 大表一輪可能很久，每個批次也算一次 tick；h 為 nil（非 daemon）時不做事
+func (h *healthState) tick() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastTick = time.Now()
+}
+
+func (h *healthState) tableDone(table string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.lastTick = now
+	th := h.tables[table]
+	if th == nil {
+		th = &tableHealth{}
+		h.tables[table] = th
+	}
+	th.LastRunAt = &now
+	if err != nil {
+		th.LastError, th.LastErrorAt = err.Error(), &now
+	} else {
+		th.LastError = ""
+	}
+}
+
+func (h *healthState) passDone() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastPass = time.Now()
+}
+
+// 目前狀態的快照；tick 在 staleAfter 內才算 ok（還沒跑完第一張表時以啟動時間計）
+func (h *healthState) report(staleAfter time.Duration) healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := healthReport{Status: "ok", StartedAt: h.started, RunID: h.runID, Tables: make(map[string]*tableHealth, len(h.tables))}
+	last := h.started
+	if !h.lastTick.IsZero() {
+		t := h.lastTick
+		r.LastTickAt, last = &t, t
+	}
+	if !h.lastPass.IsZero() {
+		t := h.lastPass
+		r.LastPassAt = &t
+	}
+	for name, th := range h.tables {
+		c := *th
+		r.Tables[name] = &c
+	}
+	if time.Since(last) > staleAfter {
+		r.Status = "stale"
+		r.Error = "main loop has not ticked for " + time.Since(last).Round(time.Second).String()
+	}
+	return r
+}
+
+func writeHealth(w http.ResponseWriter, r healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+// /healthz：主迴圈最近有在跑
+func healthzHandler(env *recomputeEnv) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeHealth(w, env.Health.report(env.Cfg.HTTP.StaleAfter))
+	}
+}
+
+// /readyz：透過 main 設定的 sql.DB 連線池 ping DB
+func readyzHandler(env *recomputeEnv) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rep := env.Health.report(env.Cfg.HTTP.StaleAfter)
+		rep.Status, rep.Error = "ok", ""
+		ctx, cancel := context.WithTimeout(req.Context(), 3*time.Second)
+		defer cancel()
+		sqlDB, err := env.DB.DB()
+		if err == nil {
+			err = sqlDB.PingContext(ctx)
+		}
+		if err != nil {
+			rep.Status, rep.Error = "db_unavailable", err.Error()
+		}
+		writeHealth(w, rep)
+	}
+}
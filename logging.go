@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+	"gorm.io/gorm"
+	glogger "gorm.io/gorm/logger"
+)
+
+// ---------- logging ----------
+
+// JSON lines，一行一筆；固定欄位名方便在日誌平台上篩選
+const (
+	logKeyTable      = "table"
+	logKeyID         = "id"
+	logKeyBatchFrom  = "batch_from"
+	logKeyBatchTo    = "batch_to"
+	logKeyRunID      = "run_id"
+	logKeyReasonCode = "reason_code"
+)
+
+func newLogger(logPath string, level slog.Level) *slog.Logger {
+	lj := &lumberjack.Logger{
+		Filename:   logPath,
+		MaxSize:    100,
+		MaxAge:     7,
+		MaxBackups: 7,
+		Compress:   false,
+	}
+	return slog.New(slog.NewJSONHandler(lj, &slog.HandlerOptions{Level: level}))
+}
+
+// config log_level：debug | info | warn | error；未設定時 isdebug=1 為 debug，否則 info
+func parseLogLevel(s string, isDebug int) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		if isDebug == 1 {
+			return slog.LevelDebug, nil
+		}
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("log_level: unknown level %q (want debug, info, warn or error)", s)
+	}
+}
+
+// 一次執行（daemon 的一輪、run-once / recompute 的一次呼叫）的識別碼，例如 20240106T101500-3fa2c1
+func newRunID() string {
+	b := make([]byte, 3)
+	_, _ = rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// ---------- reason codes ----------
+
+// recompute_info 的分類，方便統計與篩選；原因文字由 computeUpdateCached 組出
+const (
+	reasonOfficeMissing = "office_missing"
+	reasonRateMissing   = "rate_missing"
+	reasonAmountNull    = "amount_null"
+	reasonCurrencyNull  = "currency_null"
+	reasonEntryDateNull = "entry_date_null"
+	reasonNoAmount      = "no_amount_converted"
+	reasonOther         = "other"
+)
+
+// 取最主要的一個分類：辦公室 > 匯率 > 欄位 NULL
+func reasonCode(reason string) string {
+	switch {
+	case reason == "":
+		return ""
+	case strings.Contains(reason, "office not found"):
+		return reasonOfficeMissing
+	case strings.Contains(reason, "lookupRate"):
+		return reasonRateMissing
+	case strings.Contains(reason, "currency NULL"):
+		return reasonCurrencyNull
+	case strings.Contains(reason, "entry_date NULL"):
+		return reasonEntryDateNull
+	case strings.Contains(reason, " NULL"):
+		return reasonAmountNull
+	case strings.Contains(reason, "no amount converted"):
+		return reasonNoAmount
+	default:
+		return reasonOther
+	}
+}
+
+// ---------- gorm ----------
+
+// gorm 的 log 轉成 slog：SQL 錯誤 -> Error、慢查詢 -> Warn、一般 SQL -> Debug
+type gormSlogLogger struct {
+	l             *slog.Logger
+	level         glogger.LogLevel
+	slowThreshold time.Duration
+}
+
+// debug 時印出每一條 SQL；否則只印錯誤與慢查詢（原本非 debug 時全部不印，SQL 錯誤也看不到）
+func newGormLogger(l *slog.Logger, debug bool) glogger.Interface {
+	level := glogger.Warn
+	if debug {
+		level = glogger.Info
+	}
+	return gormSlogLogger{l: l.With("component", "gorm"), level: level, slowThreshold: 200 * time.Millisecond}
+}
+
+func (g gormSlogLogger) LogMode(level glogger.LogLevel) glogger.Interface {
+	g.level = level
+	return g
+}
+
+func (g gormSlogLogger) Info(ctx context.Context, msg string, args ...any) {
+	if g.level >= glogger.Info {
+		g.l.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g gormSlogLogger) Warn(ctx context.Context, msg string, args ...any) {
+	if g.level >= glogger.Warn {
+		g.l.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g gormSlogLogger) Error(ctx context.Context, msg string, args ...any) {
+	if g.level >= glogger.Error {
+		g.l.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g gormSlogLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if g.level <= glogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && g.level >= glogger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		g.l.ErrorContext(ctx, "sql error", "err", err, "sql", sql, "rows", rows, "elapsed_ms", elapsed.Milliseconds())
+	case g.slowThreshold > 0 && elapsed > g.slowThreshold && g.level >= glogger.Warn:
+		sql, rows := fc()
+		g.l.WarnContext(ctx, "slow sql", "sql", sql, "rows", rows, "elapsed_ms", elapsed.Milliseconds(),
+			"threshold_ms", g.slowThreshold.Milliseconds())
+	case g.level >= glogger.Info:
+		sql, rows := fc()
+		g.l.DebugContext(ctx, "sql", "sql", sql, "rows", rows, "elapsed_ms", elapsed.Milliseconds())
+	}
+}
@@ -3,37 +3,80 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
-	"math"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"gopkg.in/natefinch/lumberjack.v2"
+	"github.com/shopspring/decimal"
 	"gopkg.in/yaml.v3"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	glogger "gorm.io/gorm/logger"
 )
 
 // ---------- config ----------
 
 type Config struct {
-	Mode               string `yaml:"mode"`
-	RecomputeBatchSize int    `yaml:"recompute_batch_size"`
-	IsDebug            int    `yaml:"isdebug"` // 新增
-	Database           struct {
-		Development struct {
-			Dialect string `yaml:"dialect"`
-			DSN     string `yaml:"dsn"`
-		} `yaml:"development"`
-	} `yaml:"database"`
-	Dirs struct {
+	Mode               string                    `yaml:"mode"` // 選用 database 底下的哪個環境：development / staging / production
+	RecomputeBatchSize int                       `yaml:"recompute_batch_size"`
+	Workers            int                       `yaml:"workers"`        // 同時處理的表數，見 runPass / pollTable
+	PipelineDepth      int                       `yaml:"pipeline_depth"` // 單表內最多幾批先撈好等寫回；0 = 依序處理，見 handleTable
+	IsDebug            int                       `yaml:"isdebug"`        // 新增
+	LogLevel           string                    `yaml:"log_level"`
+	Level              slog.Level                `yaml:"-"` // 由 log_level / isdebug 決定，見 parseLogLevel
+	Database           map[string]DatabaseConfig `yaml:"database"`
+	DB                 DatabaseConfig            `yaml:"-"` // 依 mode 選出的連線設定（已套用 TWACC_DATABASE_*）
+	Dirs               struct {
 		Logs string `yaml:"logs"`
 	} `yaml:"dirs"`
+	Rates    RateConfig     `yaml:"rates"`
+	Rounding RoundingConfig `yaml:"rounding"`
+	// 表對應：mappings_file（獨立 YAML，格式同 tables）優先，其次 tables；都沒設定則用內建 TableFieldMappings
+	MappingsFile string             `yaml:"mappings_file"`
+	Tables       []tableMappingSpec `yaml:"tables"`
+	// 啟動時對照 information_schema 檢查表對應：fail（預設，拒絕啟動）| disable（停用有問題的表）| off
+	SchemaCheck string `yaml:"schema_check"`
+	// daemon 的 HTTP 端點（/metrics、/healthz、/readyz）；addr 空字串不開
+	HTTP HTTPConfig `yaml:"http"`
+	// 持續失敗的資料依指數退避延後重試（見 retry.go）
+	Retry RetryConfig `yaml:"retry"`
+	// 寫回時把每個變動欄位的舊值/新值記到 acc_recompute_audit（見 audit.go），undo 需要
+	Audit bool `yaml:"audit"`
+}
+
+type DatabaseConfig struct {
+	Dialect string `yaml:"dialect"`
+	DSN     string `yaml:"dsn"`
+}
+
+// 反向匯率取倒數時保留的小數位數（1/r 無法精確表示，其餘運算皆為精確乘法）
+const inverseRatePrecision = 16
+
+// 匯率解析方向
+const (
+	rateDirect  = "direct"
+	rateInverse = "inverse"
+)
+
+// 匯率解析設定
+type RateConfig struct {
+	// 當日無匯率時，最多往前找幾天（0 = 只用當日）
+	LookbackDays int `yaml:"lookback_days"`
+	// 缺少直接匯率時可經由的中介幣別，依序嘗試，例如 PHP->USDT = PHP->CNY × CNY->USDT
+	Pivots []string `yaml:"pivots"`
+	// 單一幣對的解析順序：direct = 直接匯率，inverse = 反向匯率取倒數；預設只用 direct
+	ResolveOrder []string `yaml:"resolve_order"`
+	// 匯率來源：db（sys_currency_rate_record，預設）、file（CSV/JSON 檔）、static（下方 static 表）
+	Source string       `yaml:"source"`
+	File   string       `yaml:"file"`
+	Static []rateRecord `yaml:"static"`
 }
 
 func loadConfig(path string) (Config, error) {
@@ -45,9 +88,87 @@ func loadConfig(path string) (Config, error) {
 	if err := yaml.Unmarshal(b, &cfg); err != nil {
 		return cfg, err
 	}
+	// 環境變數優先於設定檔
+	if err := applyEnvOverrides(&cfg, envPrefix); err != nil {
+		return cfg, err
+	}
+	cfg.Mode = strings.ToLower(strings.TrimSpace(cfg.Mode))
+	if cfg.Mode == "" {
+		cfg.Mode = "development"
+	}
+	db, ok := cfg.Database[cfg.Mode]
+	if !ok {
+		// DSN 來自環境變數時也要求 database 底下有這個 mode，避免 mode 打錯字卻連到環境變數的 DB
+		return cfg, fmt.Errorf("mode %q has no entry under database (have %v)", cfg.Mode, sortedKeys(cfg.Database))
+	}
+	cfg.DB = db
+	if v, ok := os.LookupEnv(envPrefix + "_DATABASE_DSN"); ok {
+		cfg.DB.DSN = v
+	}
+	if v, ok := os.LookupEnv(envPrefix + "_DATABASE_DIALECT"); ok {
+		cfg.DB.Dialect = v
+	}
+	if cfg.DB.DSN == "" {
+		return cfg, fmt.Errorf("database.%s.dsn is empty (mode=%s; set it in config or %s_DATABASE_DSN)", cfg.Mode, cfg.Mode, envPrefix)
+	}
+	if cfg.DB.Dialect != "" && cfg.DB.Dialect != "mysql" {
+		return cfg, fmt.Errorf("database.%s.dialect %q is not supported (only mysql)", cfg.Mode, cfg.DB.Dialect)
+	}
 	if cfg.RecomputeBatchSize <= 0 {
 		cfg.RecomputeBatchSize = 100 // 需求：預設 100
 	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	if cfg.PipelineDepth < 0 {
+		return cfg, fmt.Errorf("pipeline_depth must be >= 0, got %d", cfg.PipelineDepth)
+	}
+	// pipeline 時每個 worker 同時佔兩條連線：一條撈下一批，一條寫回
+	connsPerWorker := 1
+	if cfg.PipelineDepth > 0 {
+		connsPerWorker = 2
+	}
+	if cfg.Workers*connsPerWorker > maxWorkers {
+		return cfg, fmt.Errorf("workers x %d must be <= %d (db pool has %d connections, one is kept for health checks and metrics), got workers=%d pipeline_depth=%d",
+			connsPerWorker, maxWorkers, dbMaxOpenConns, cfg.Workers, cfg.PipelineDepth)
+	}
+	if cfg.Rates.LookbackDays < 0 {
+		return cfg, fmt.Errorf("rates.lookback_days must be >= 0, got %d", cfg.Rates.LookbackDays)
+	}
+	cfg.Rates.Source = strings.ToLower(strings.TrimSpace(cfg.Rates.Source))
+	for i, p := range cfg.Rates.Pivots {
+		cfg.Rates.Pivots[i] = strings.ToUpper(strings.TrimSpace(p))
+	}
+	if len(cfg.Rates.ResolveOrder) == 0 {
+		cfg.Rates.ResolveOrder = []string{rateDirect}
+	}
+	for i, m := range cfg.Rates.ResolveOrder {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if m != rateDirect && m != rateInverse {
+			return cfg, fmt.Errorf("rates.resolve_order: unknown method %q (want %s or %s)", m, rateDirect, rateInverse)
+		}
+		cfg.Rates.ResolveOrder[i] = m
+	}
+	cfg.SchemaCheck = strings.ToLower(strings.TrimSpace(cfg.SchemaCheck))
+	switch cfg.SchemaCheck {
+	case "":
+		cfg.SchemaCheck = schemaCheckFail
+	case schemaCheckFail, schemaCheckDisable, schemaCheckOff:
+	default:
+		return cfg, fmt.Errorf("schema_check: unknown value %q (want fail, disable or off)", cfg.SchemaCheck)
+	}
+	if err := cfg.Rounding.normalize(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Retry.normalize(); err != nil {
+		return cfg, err
+	}
+	if cfg.Level, err = parseLogLevel(cfg.LogLevel, cfg.IsDebug); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTP.StaleAfter <= 0 {
+		cfg.HTTP.StaleAfter = 10 * time.Minute
+	}
 	if cfg.Dirs.Logs == "" {
 		cfg.Dirs.Logs = "."
 	}
@@ -56,36 +177,31 @@ func loadConfig(path string) (Config, error) {
 	return cfg, nil
 }
 
-// ---------- logging ----------
-
-func newLogger(logPath string) *log.Logger {
-	lj := &lumberjack.Logger{
-		Filename:   logPath,
-		MaxSize:    100,
-		MaxAge:     7,
-		MaxBackups: 7,
-		Compress:   false,
-	}
-	return log.New(lj, "", log.LstdFlags)
-}
-
 // ---------- data structures ----------
 
 type AmountFieldSet struct {
-	Base string
-	Usdt string
-	Cny  string
+	Base string `yaml:"base"`
+	Usdt string `yaml:"usdt"`
+	Cny  string `yaml:"cny"`
 }
 
 type FieldMapping struct {
-	BaseAmount string
-	CnyAmount  string
-	UsdtAmount string
-	MainCode   string
-	SubCode    string
-	SiteCode   string
-	IDColumn   string
-	AmountSets []AmountFieldSet
+	BaseAmount string `yaml:"-"`
+	CnyAmount  string `yaml:"-"`
+	UsdtAmount string `yaml:"-"`
+	MainCode   string `yaml:"main_code"`
+	SubCode    string `yaml:"sub_code"`
+	SiteCode   string `yaml:"site_code"`
+	IDColumn   string `yaml:"id_column"`
+	// 只補辦公室/站點，不做金額換算（沒有 currency/entry_date 欄位），例如 acc_channel_info
+	OfficeOnly bool `yaml:"office_only"`
+	// 啟動時依命名慣例（X / X_usdt / X_cny，不分大小寫）從 information_schema 補齊 AmountSets
+	AutoDiscover bool                    `yaml:"auto_discover"`
+	AmountSets   []AmountFieldSet        `yaml:"amount_sets"`
+	Rounding     map[string]RoundingRule `yaml:"rounding"` // key: 換算後欄位（usdt/cny），覆蓋全域/幣別的捨入規則
+	// 寫回時的樂觀鎖欄位（例如 updated_at、version），與 status 一起比對讀取時的值；
+	// 空白時啟動依 schema 偵測（見 detectVersionColumns），"-" 代表只比對 status
+	VersionColumn string `yaml:"version_column"`
 }
 
 type recordRow struct {
@@ -94,7 +210,12 @@ type recordRow struct {
 	EntryDate sql.NullTime
 	SubCode   string
 	SiteCode  string
-	Amounts   map[string]sql.NullFloat64 // key: column name
+	Amounts   map[string]decimal.NullDecimal // key: column name；用 decimal 保留 DECIMAL 欄位精度
+	// 寫回前的現值，供 dry-run diff / 稽核使用
+	Status        int
+	RecomputeInfo sql.NullString
+	Offices       map[string]sql.NullString // key: officeColumns 中的欄位
+	Version       any                       // mapping.VersionColumn 的原始值（driver value），寫回時原樣比對
 }
 
 type officeInfo struct {
@@ -104,10 +225,27 @@ type officeInfo struct {
 	MainOffice string
 	SubOffice  string
 	Site       string
+	// 命中的 data_office_* 列 id（explain / 稽核用；sub 路徑沒有 SiteID）
+	MainID uint64
+	SubID  uint64
+	SiteID uint64
 }
 
 // ---------- table mappings (同原本) ---------
-/* 省略：保持原 TableFieldMappings 全表定義，與你現有一致即可 */
+/* 內建預設；config 的 tables / mappings_file 有設定時會被取代，見 mappings.go */
+
+// 處理順序
+var TableOrder = []string{
+	"acc_cashbook",
+	"acc_expenses",
+	"acc_borrow_lend",
+	"acc_recharge_withdraw",
+	"acc_channel_info",
+	"acc_ad_performance_analysis",
+	"acc_balance_sheet",
+	"acc_revenue_expense_adjustments",
+	"acc_operational_information",
+}
 
 var TableFieldMappings = map[string]FieldMapping{
 	"acc_cashbook": {
@@ -145,6 +283,7 @@ var TableFieldMappings = map[string]FieldMapping{
 	},
 	"acc_channel_info": {
 		MainCode: "main_office", SubCode: "sub_office", SiteCode: "site_code", IDColumn: "id",
+		OfficeOnly: true,
 	},
 	"acc_ad_performance_analysis": {
 		MainCode: "main_office", SubCode: "sub_office", SiteCode: "site_code", IDColumn: "id",
@@ -202,7 +341,21 @@ var TableFieldMappings = map[string]FieldMapping{
 
 // ---------- helpers ----------
 
-func round2(v float64) float64 { return math.Round(v*100) / 100 }
+// computeUpdateCached 補辦公室/站點時可能寫入的欄位（去重，依固定順序）
+func officeColumns(mapping FieldMapping) []string {
+	cols := []string{}
+	seen := map[string]bool{}
+	for _, c := range []string{mapping.MainCode, mapping.SubCode, mapping.SiteCode, "main_office", "sub_office"} {
+		if c != "" && !seen[c] {
+			seen[c] = true
+			cols = append(cols, c)
+		}
+	}
+	if mapping.SiteCode != "" && !seen["site"] {
+		cols = append(cols, "site")
+	}
+	return cols
+}
 
 func mapKeys(m map[string]struct{}) []string {
 	keys := make([]string, 0, len(m))
@@ -214,13 +367,14 @@ func mapKeys(m map[string]struct{}) []string {
 
 // ---------- 批次預撈主資料 ----------
 
-func fetchRecordsBatch(ctx context.Context, db *gorm.DB, table string, ids []uint64, mapping FieldMapping, sets []AmountFieldSet) (map[uint64]recordRow, error) {
+// onlyPending=true 時只撈 status=2 的資料
+func fetchRecordsBatch(ctx context.Context, db *gorm.DB, table string, ids []uint64, mapping FieldMapping, sets []AmountFieldSet, onlyPending bool) (map[uint64]recordRow, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
 
 	cols := []string{fmt.Sprintf("`%s` AS id", mapping.IDColumn)}
-	includeCurDate := table != "acc_channel_info"
+	includeCurDate := !mapping.OfficeOnly
 	if includeCurDate {
 		cols = append(cols, "`currency`", "`entry_date`")
 	}
@@ -230,6 +384,15 @@ func fetchRecordsBatch(ctx context.Context, db *gorm.DB, table string, ids []uin
 	if mapping.SiteCode != "" {
 		cols = append(cols, fmt.Sprintf("`%s` AS site_code", mapping.SiteCode))
 	}
+	cols = append(cols, "`status`", "`recompute_info`")
+	versionCol := mapping.versionColumn()
+	if versionCol != "" {
+		cols = append(cols, fmt.Sprintf("`%s`", versionCol))
+	}
+	officeCols := officeColumns(mapping)
+	for _, c := range officeCols {
+		cols = append(cols, fmt.Sprintf("`%s`", c))
+	}
 
 	// 若呼叫方傳入的 sets 為空，補上表的預設 AmountSets
 	if len(sets) == 0 {
@@ -249,15 +412,15 @@ func fetchRecordsBatch(ctx context.Context, db *gorm.DB, table string, ids []uin
 		}
 	}
 
-	// 金額欄位為空，除 acc_channel_info 外都視為錯誤
-	if table != "acc_channel_info" && len(amountCols) == 0 {
-		log.Printf("[debug][%s] amountCols EMPTY | sets=%+v | mapping.AmountSets=%+v", table, sets, mapping.AmountSets)
+	// 金額欄位為空，除 office_only 表（acc_channel_info）外都視為錯誤
+	if !mapping.OfficeOnly && len(amountCols) == 0 {
+		slog.Debug("amount columns empty", logKeyTable, table, "sets", sets, "mapping_sets", mapping.AmountSets)
 		return map[uint64]recordRow{}, nil
 	}
 
 	amountColList := mapKeys(amountCols)
 	sort.Strings(amountColList)
-	log.Printf("[debug-cols][%s] amountColList=%v", table, amountColList)
+	slog.Debug("amount columns", logKeyTable, table, "columns", amountColList)
 
 	for _, c := range amountColList { // 這裡原本是 for c := range amountCols
 		if c != "" {
@@ -265,9 +428,12 @@ func fetchRecordsBatch(ctx context.Context, db *gorm.DB, table string, ids []uin
 		}
 	}
 
-	sqlStr := fmt.Sprintf("SELECT %s FROM `%s` WHERE `%s` IN ? AND status = 2", strings.Join(cols, ","), table, mapping.IDColumn)
+	sqlStr := fmt.Sprintf("SELECT %s FROM `%s` WHERE `%s` IN ?", strings.Join(cols, ","), table, mapping.IDColumn)
+	if onlyPending {
+		sqlStr += " AND status = 2"
+	}
 	rows, err := db.WithContext(ctx).Raw(sqlStr, ids).Rows()
-	log.Printf("[debug-sql][%s] %s", table, sqlStr)
+	slog.Debug("fetch records", logKeyTable, table, "sql", sqlStr)
 
 	if err != nil {
 		return nil, err
@@ -288,10 +454,19 @@ func fetchRecordsBatch(ctx context.Context, db *gorm.DB, table string, ids []uin
 		if mapping.SiteCode != "" {
 			scanTargets = append(scanTargets, &site)
 		}
+		var status sql.NullInt64
+		scanTargets = append(scanTargets, &status, &rr.RecomputeInfo)
+		if versionCol != "" {
+			scanTargets = append(scanTargets, &rr.Version)
+		}
+		officeVals := make([]sql.NullString, len(officeCols))
+		for i := range officeVals {
+			scanTargets = append(scanTargets, &officeVals[i])
+		}
 
-		amountPtrs := make(map[string]*sql.NullFloat64, len(amountCols)) // 這行是關鍵，不能少
+		amountPtrs := make(map[string]*decimal.NullDecimal, len(amountCols)) // 這行是關鍵，不能少
 		for _, c := range amountColList {
-			v := sql.NullFloat64{}
+			v := decimal.NullDecimal{}
 			amountPtrs[c] = &v
 			scanTargets = append(scanTargets, amountPtrs[c])
 		}
@@ -305,7 +480,12 @@ func fetchRecordsBatch(ctx context.Context, db *gorm.DB, table string, ids []uin
 		if site.Valid {
 			rr.SiteCode = site.String
 		}
-		rr.Amounts = make(map[string]sql.NullFloat64, len(amountCols))
+		rr.Status = int(status.Int64)
+		rr.Offices = make(map[string]sql.NullString, len(officeCols))
+		for i, c := range officeCols {
+			rr.Offices[c] = officeVals[i]
+		}
+		rr.Amounts = make(map[string]decimal.NullDecimal, len(amountCols))
 		for c, p := range amountPtrs {
 			rr.Amounts[c] = *p
 		}
@@ -334,7 +514,7 @@ func prefetchOffices(ctx context.Context, db *gorm.DB, recMap map[uint64]recordR
 	if len(siteSet) > 0 {
 		keys := mapKeys(siteSet)
 		rows, err := db.WithContext(ctx).Raw(`
-			SELECT t.site_code, m.main_code, m.name, s.sub_code, s.name, t.name
+			SELECT t.site_code, m.main_code, m.name, s.sub_code, s.name, t.name, m.id, s.id, t.id
 			FROM data_office_site t
 			JOIN data_office_sub s ON s.id = t.office_sub_id
 			JOIN data_office_main m ON m.id = s.office_main_id
@@ -348,13 +528,15 @@ func prefetchOffices(ctx context.Context, db *gorm.DB, recMap map[uint64]recordR
 		defer rows.Close()
 		for rows.Next() {
 			var sc, mc, mn, sbc, sbn, stn string
-			if err := rows.Scan(&sc, &mc, &mn, &sbc, &sbn, &stn); err != nil {
+			var mid, sid, tid uint64
+			if err := rows.Scan(&sc, &mc, &mn, &sbc, &sbn, &stn, &mid, &sid, &tid); err != nil {
 				return nil, nil, err
 			}
 			siteMap[sc] = officeInfo{
 				MainCode: mc, MainOffice: mn,
 				SubCode: sbc, SubOffice: sbn,
 				SiteCode: sc, Site: sc,
+				MainID: mid, SubID: sid, SiteID: tid,
 			}
 		}
 	}
@@ -363,7 +545,7 @@ func prefetchOffices(ctx context.Context, db *gorm.DB, recMap map[uint64]recordR
 	if len(subSet) > 0 {
 		keys := mapKeys(subSet)
 		rows, err := db.WithContext(ctx).Raw(`
-			SELECT s.sub_code, m.main_code, m.name, s.sub_code, s.name
+			SELECT s.sub_code, m.main_code, m.name, s.sub_code, s.name, m.id, s.id
 			FROM data_office_sub s
 			JOIN data_office_main m ON m.id = s.office_main_id
 			WHERE s.deleted_at IS NULL AND m.deleted_at IS NULL
@@ -376,12 +558,14 @@ func prefetchOffices(ctx context.Context, db *gorm.DB, recMap map[uint64]recordR
 		defer rows.Close()
 		for rows.Next() {
 			var sc, mc, mn, sbc, sbn string
-			if err := rows.Scan(&sc, &mc, &mn, &sbc, &sbn); err != nil {
+			var mid, sid uint64
+			if err := rows.Scan(&sc, &mc, &mn, &sbc, &sbn, &mid, &sid); err != nil {
 				return nil, nil, err
 			}
 			subMap[sc] = officeInfo{
 				MainCode: mc, MainOffice: mn,
 				SubCode: sbc, SubOffice: sbn,
+				MainID: mid, SubID: sid,
 			}
 		}
 	}
@@ -389,7 +573,7 @@ func prefetchOffices(ctx context.Context, db *gorm.DB, recMap map[uint64]recordR
 	return siteMap, subMap, nil
 }
 
-// ---------- 批次預撈匯率（一次撈兩方向） ----------
+// ---------- 批次預撈匯率（一次撈兩方向，來源見 ratesource.go） ----------
 
 type rateKey struct {
 	Date string
@@ -397,104 +581,209 @@ type rateKey struct {
 	To   string
 }
 
+// 預撈結果：匯率表 + 解析設定
+type rateCache struct {
+	rates map[rateKey]decimal.Decimal
+	opts  RateConfig
+}
+
+// 查到的匯率與實際使用的匯率日期
+type rateHit struct {
+	Rate decimal.Decimal
+	Date string // 經中介幣別時取各段中最舊的日期
+	Path string // 經中介幣別時的路徑，例如 PHP->CNY->USDT；直接匯率為空
+	// 任一段用了反向匯率時為 inverse，否則為 direct
+	Direction string
+}
+
 // 1) 統一 rate key：prefetchRates
-func prefetchRates(ctx context.Context, db *gorm.DB, recMap map[uint64]recordRow) (map[rateKey]float64, error) {
+// 每個 entry_date 會一併撈往前 lookback_days 天，讓週末/假日可以回退到最近一筆匯率
+func prefetchRates(ctx context.Context, src RateSource, recMap map[uint64]recordRow, opts RateConfig) (*rateCache, error) {
+	rc := &rateCache{rates: map[rateKey]decimal.Decimal{}, opts: opts}
 	dateSet := map[string]struct{}{}
 	curSet := map[string]struct{}{}
 	for _, r := range recMap {
 		if !r.EntryDate.Valid || !r.Currency.Valid {
 			continue
 		}
-		dateSet[r.EntryDate.Time.Format("2006-01-02")] = struct{}{}
+		for i := 0; i <= opts.LookbackDays; i++ {
+			dateSet[r.EntryDate.Time.AddDate(0, 0, -i).Format("2006-01-02")] = struct{}{}
+		}
 		cur := strings.ToUpper(strings.TrimSpace(r.Currency.String))
 		curSet[cur] = struct{}{}
 	}
 	if len(dateSet) == 0 || len(curSet) == 0 {
-		return map[rateKey]float64{}, nil
+		return rc, nil
 	}
 
-	dates := mapKeys(dateSet)
-	curs := mapKeys(curSet)
+	// 中介幣別的兩段（cur->pivot、pivot->目標）也要一起撈
+	toSet := map[string]struct{}{"CNY": {}, "USDT": {}}
+	for _, p := range opts.Pivots {
+		curSet[p] = struct{}{}
+		toSet[p] = struct{}{}
+	}
+	// 允許反向匯率時，from/to 兩邊都要撈
+	if opts.allows(rateInverse) {
+		for c := range curSet {
+			toSet[c] = struct{}{}
+		}
+		for c := range toSet {
+			curSet[c] = struct{}{}
+		}
+	}
 
-	rows, err := db.WithContext(ctx).Raw(`
-        SELECT DATE(date_at) AS date_at, currency_from, currency_to, rate
-        FROM sys_currency_rate_record
-        WHERE deleted_at IS NULL
-          AND currency_to IN ('CNY','USDT')
-          AND DATE(date_at) IN ?
-          AND currency_from IN ?
-        ORDER BY id DESC
-    `, dates, curs).Rows()
+	recs, err := src.LoadRates(ctx, mapKeys(dateSet), mapKeys(curSet), mapKeys(toSet))
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	rateMap := map[rateKey]float64{}
-	for rows.Next() {
-		var d, f, t string
-		var rate float64
-		if err := rows.Scan(&d, &f, &t, &rate); err != nil {
-			return nil, err
-		}
-		d = strings.TrimSpace(d)
-		if len(d) >= 10 { // 確保只留日期
-			d = d[:10]
-		}
-		k := rateKey{
-			Date: d,
-			From: strings.ToUpper(strings.TrimSpace(f)),
-			To:   strings.ToUpper(strings.TrimSpace(t)),
-		}
-		if _, ok := rateMap[k]; !ok { // 依 id DESC，只收最新
-			rateMap[k] = rate
+	for _, r := range recs {
+		r = normalizeRateRecord(r)
+		k := rateKey{Date: r.Date, From: r.From, To: r.To}
+		if _, ok := rc.rates[k]; !ok { // 來源保證最新在前，只收最新
+			rc.rates[k] = r.Rate
 		}
 	}
 
-	return rateMap, nil
+	return rc, nil
 }
 
 // ---------- 辦公室/匯率查 cache ----------
 
-func resolveOfficeCached(mapping FieldMapping, rec recordRow, siteMap, subMap map[string]officeInfo) (officeInfo, string) {
+const (
+	officePathSite = "site_code" // data_office_site -> sub -> main
+	officePathSub  = "sub_code"  // data_office_sub -> main
+)
+
+// 回傳的 path 為實際走的查詢路徑（officePathSite / officePathSub），兩者都不適用時為空字串
+func resolveOfficeCached(mapping FieldMapping, rec recordRow, siteMap, subMap map[string]officeInfo) (officeInfo, string, string) {
 	if mapping.SiteCode != "" && rec.SiteCode != "" {
 		if oi, ok := siteMap[rec.SiteCode]; ok {
-			return oi, ""
+			return oi, officePathSite, ""
 		}
-		return officeInfo{}, "office not found by site_code"
+		return officeInfo{}, officePathSite, "office not found by site_code"
 	}
 	if mapping.SubCode != "" && rec.SubCode != "" {
 		if oi, ok := subMap[rec.SubCode]; ok {
-			return oi, ""
+			return oi, officePathSub, ""
 		}
-		return officeInfo{}, "office not found by sub_code"
+		return officeInfo{}, officePathSub, "office not found by sub_code"
 	}
-	return officeInfo{}, ""
+	return officeInfo{}, "", ""
 }
 
 // 2) 自幣對自幣直接回 1，並標準化 from/to
-func lookupRateCached(rateMap map[rateKey]float64, date time.Time, from, to string) (float64, error) {
+// 先找直接匯率，找不到再依序經 pivots 推算
+func lookupRateCached(rc *rateCache, date time.Time, from, to string) (rateHit, error) {
 	from = strings.ToUpper(strings.TrimSpace(from))
 	to = strings.ToUpper(strings.TrimSpace(to))
+	day := date.Format("2006-01-02")
 	if from == to {
-		return 1, nil
+		return rateHit{Rate: decimal.NewFromInt(1), Date: day, Direction: rateDirect}, nil
+	}
+	if hit, ok := rc.lookupLeg(date, from, to); ok {
+		return hit, nil
+	}
+	for _, p := range rc.opts.Pivots {
+		if p == from || p == to {
+			continue
+		}
+		leg1, ok1 := rc.lookupLeg(date, from, p)
+		if !ok1 {
+			continue
+		}
+		leg2, ok2 := rc.lookupLeg(date, p, to)
+		if !ok2 {
+			continue
+		}
+		d := leg1.Date
+		if leg2.Date < d {
+			d = leg2.Date
+		}
+		dir := rateDirect
+		if leg1.Direction == rateInverse || leg2.Direction == rateInverse {
+			dir = rateInverse
+		}
+		return rateHit{Rate: leg1.Rate.Mul(leg2.Rate), Date: d, Path: from + "->" + p + "->" + to, Direction: dir}, nil
+	}
+
+	msg := fmt.Sprintf("lookupRate: no rate for %s %s->%s", day, from, to)
+	if rc.opts.LookbackDays > 0 {
+		msg += fmt.Sprintf(" within %d days", rc.opts.LookbackDays)
+	}
+	if len(rc.opts.Pivots) > 0 {
+		msg += " (pivots " + strings.Join(rc.opts.Pivots, ",") + ")"
+	}
+	return rateHit{}, errors.New(msg)
+}
+
+// 單一幣對：由 entry_date 往前找，取 lookback_days 內最新（日期最近）的一筆；
+// 同一天內依 resolve_order 決定先用直接匯率還是反向匯率的倒數
+func (rc *rateCache) lookupLeg(date time.Time, from, to string) (rateHit, bool) {
+	for i := 0; i <= rc.opts.LookbackDays; i++ {
+		d := date.AddDate(0, 0, -i).Format("2006-01-02")
+		for _, m := range rc.opts.ResolveOrder {
+			switch m {
+			case rateDirect:
+				if r, ok := rc.rates[rateKey{Date: d, From: from, To: to}]; ok {
+					return rateHit{Rate: r, Date: d, Direction: rateDirect}, true
+				}
+			case rateInverse:
+				if r, ok := rc.rates[rateKey{Date: d, From: to, To: from}]; ok && !r.IsZero() {
+					return rateHit{Rate: decimal.NewFromInt(1).DivRound(r, inverseRatePrecision), Date: d, Direction: rateInverse}, true
+				}
+			}
+		}
 	}
-	k := rateKey{Date: date.Format("2006-01-02"), From: from, To: to}
-	if r, ok := rateMap[k]; ok {
-		return r, nil
+	return rateHit{}, false
+}
+
+func (o RateConfig) allows(method string) bool {
+	for _, m := range o.ResolveOrder {
+		if m == method {
+			return true
+		}
 	}
-	return 0, fmt.Errorf("lookupRate: no rate for %s %s->%s", k.Date, from, to)
+	return false
+}
+
+// 使用了回退日期、中介幣別或反向匯率時的備註，成功換算時以 info 記進 log（recompute_info 只放失敗原因）
+func rateNote(date time.Time, from, to string, hit rateHit) string {
+	parts := []string{}
+	if hit.Path != "" {
+		parts = append(parts, "path="+hit.Path)
+	}
+	if hit.Date != date.Format("2006-01-02") {
+		parts = append(parts, "rate_date="+hit.Date)
+	}
+	if hit.Direction == rateInverse {
+		parts = append(parts, "direction="+rateInverse)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s->%s %s", from, to, strings.Join(parts, " "))
 }
 
 // ---------- per-record 計算（用 cache，不打 DB） ----------
 // 0206jamie: 調整 computeUpdateCached，
 func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec recordRow,
-	siteMap, subMap map[string]officeInfo, rateMap map[rateKey]float64,
-	table string, logger *log.Logger) (map[string]any, string) {
+	siteMap, subMap map[string]officeInfo, rc *rateCache, rounding RoundingConfig,
+	table string, logger *slog.Logger, trace *computeTrace) (map[string]any, string) {
 
-	office, officeReason := resolveOfficeCached(mapping, rec, siteMap, subMap)
+	office, officePath, officeReason := resolveOfficeCached(mapping, rec, siteMap, subMap)
+	if trace != nil {
+		trace.OfficePath, trace.Office, trace.OfficeReason = officePath, office, officeReason
+	}
 	allOK := (officeReason == "")
 	rateReason := ""
+	rateNotes := ""                // 成功但使用了回退匯率/中介幣別/反向匯率時的說明
+	seenNotes := map[string]bool{} // 多組金額用同一匯率時只記一次
+	addNote := func(n string) {
+		if n != "" && !seenNotes[n] {
+			seenNotes[n] = true
+			rateNotes = appendReason(rateNotes, n)
+		}
+	}
 	update := map[string]any{}
 	convertedCount := 0 // 至少有一個金額成功換算才算成功
 
@@ -503,6 +792,19 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 
 	for _, set := range sets {
 		baseCol, usdtCol, cnyCol := set.Base, set.Usdt, set.Cny
+		st := trace.addSet(set, rec.Amounts[baseCol])
+		lookup := func(from, to string) (rateHit, error) {
+			hit, err := lookupRateCached(rc, dt, from, to)
+			st.addLookup(dt, from, to, hit, err)
+			return hit, err
+		}
+		convert := func(col, target string, base decimal.Decimal, hit rateHit) decimal.Decimal {
+			rule := roundingFor(rounding, mapping, col, target)
+			raw := base.Mul(hit.Rate)
+			v := rule.apply(raw)
+			st.addOutput(outputTrace{Column: col, Target: target, Rate: hit.Rate, Raw: raw, Rule: &rule, Value: v})
+			return v
+		}
 		// baseVal, ok := rec.Amounts[baseCol]
 		// if !ok {
 		// 	continue
@@ -514,23 +816,27 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 			for k := range rec.Amounts {
 				amountKeys = append(amountKeys, k)
 			}
-			logger.Printf("[debug][%s][%d] base column not found: %s | amounts keys=%v", table, rec.ID, baseCol, amountKeys)
+			logger.Debug("base column not found", logKeyTable, table, logKeyID, rec.ID, "column", baseCol, "amount_keys", amountKeys)
+			st.skip("base column not scanned")
 			continue
 		}
 
-		// acc_channel_info 不做金額換算
-		if table == "acc_channel_info" {
+		// office_only（acc_channel_info）不做金額換算
+		if mapping.OfficeOnly {
+			st.skip("office_only")
 			continue
 		}
 
 		if !baseVal.Valid {
-			logger.Printf("[%s][%d] base is NULL => skip FX update (base=%s usdt=%s cny=%s)", table, rec.ID, baseCol, usdtCol, cnyCol)
+			logger.Debug("base is NULL, skip FX update", logKeyTable, table, logKeyID, rec.ID, "base", baseCol, "usdt", usdtCol, "cny", cnyCol)
 			allOK = false
 			rateReason = appendReason(rateReason, baseCol+" NULL")
+			st.skip(baseCol + " NULL")
 			continue
 		}
 		if !rec.Currency.Valid || !rec.EntryDate.Valid {
 			allOK = false
+			st.skip("currency or entry_date NULL")
 			if !rec.Currency.Valid {
 				rateReason = appendReason(rateReason, "currency NULL")
 			}
@@ -540,7 +846,7 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 			continue
 		}
 
-		base := baseVal.Float64
+		base := baseVal.Decimal
 		amountCny := base
 		amountUsdt := base
 		rateOK := true
@@ -548,24 +854,28 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 
 		switch cur {
 		case "CNY":
-			r, err := lookupRateCached(rateMap, dt, "CNY", "USDT")
+			r, err := lookup("CNY", "USDT")
 			if err != nil {
 				rateOK = false
 				rReason = err.Error()
 			} else {
-				amountUsdt = round2(base * r)
+				st.addOutput(outputTrace{Column: cnyCol, Target: "CNY", Rate: decimal.NewFromInt(1), Raw: base, Value: base})
+				amountUsdt = convert(usdtCol, "USDT", base, r)
+				addNote(rateNote(dt, "CNY", "USDT", r))
 			}
 		case "USDT":
-			r, err := lookupRateCached(rateMap, dt, "USDT", "CNY")
+			r, err := lookup("USDT", "CNY")
 			if err != nil {
 				rateOK = false
 				rReason = err.Error()
 			} else {
-				amountCny = round2(base * r)
+				amountCny = convert(cnyCol, "CNY", base, r)
+				st.addOutput(outputTrace{Column: usdtCol, Target: "USDT", Rate: decimal.NewFromInt(1), Raw: base, Value: base})
+				addNote(rateNote(dt, "USDT", "CNY", r))
 			}
 		default:
-			rCNY, err1 := lookupRateCached(rateMap, dt, cur, "CNY")
-			rUSDT, err2 := lookupRateCached(rateMap, dt, cur, "USDT")
+			rCNY, err1 := lookup(cur, "CNY")
+			rUSDT, err2 := lookup(cur, "USDT")
 			if err1 != nil {
 				rateOK = false
 				rReason = err1.Error()
@@ -573,8 +883,10 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 				rateOK = false
 				rReason = err2.Error()
 			} else {
-				amountCny = round2(base * rCNY)
-				amountUsdt = round2(base * rUSDT)
+				amountCny = convert(cnyCol, "CNY", base, rCNY)
+				amountUsdt = convert(usdtCol, "USDT", base, rUSDT)
+				addNote(rateNote(dt, cur, "CNY", rCNY))
+				addNote(rateNote(dt, cur, "USDT", rUSDT))
 			}
 		}
 
@@ -582,6 +894,7 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 			update[cnyCol] = amountCny
 			update[usdtCol] = amountUsdt
 			convertedCount++
+			st.written()
 		} else {
 			allOK = false
 			rateReason = appendReason(rateReason, rReason)
@@ -589,8 +902,9 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 	}
 
 	// 若有金額欄位但一欄都沒成功換算，仍視為失敗 0206 debug jamie
-	if table != "acc_channel_info" && len(sets) > 0 && convertedCount == 0 {
-		logger.Printf("[debug][%s][%d] convertedCount=0 currency=%v entry_date=%v amounts=%v", table, rec.ID, rec.Currency, rec.EntryDate, rec.Amounts)
+	if !mapping.OfficeOnly && len(sets) > 0 && convertedCount == 0 {
+		logger.Debug("no amount converted", logKeyTable, table, logKeyID, rec.ID,
+			"currency", rec.Currency.String, "entry_date", rec.EntryDate.Time, "amounts", rec.Amounts)
 		allOK = false
 		rateReason = appendReason(rateReason, "no amount converted")
 	}
@@ -618,7 +932,12 @@ func computeUpdateCached(mapping FieldMapping, sets []AmountFieldSet, rec record
 	reasonText := buildReason(officeReason, rateReason)
 	if allOK {
 		update["status"] = 1
-		update["recompute_info"] = nil
+		update["recompute_info"] = nil // 非 NULL 代表失敗原因，成功時一律清空
+		if rateNotes != "" {
+			// 用了非當日匯率、中介幣別或反向匯率：實際匯率日期/路徑/方向記在 info log（預設開啟）供對帳，
+			// audit 啟用時稽核表的 rate_key 也有
+			logger.Info("rate fallback/pivot/inverse", logKeyTable, table, logKeyID, rec.ID, "rate_note", rateNotes)
+		}
 	} else {
 		update["status"] = 2
 		update["recompute_info"] = reasonText
@@ -647,65 +966,96 @@ func buildReason(officeReason, rateReason string) string {
 	return strings.Join(parts, "; ")
 }
 
-// 批次 UPDATE：用 CASE 把多筆合成一條 SQL（無插入路徑）
-func batchUpdate(ctx context.Context, db *gorm.DB, table, idCol string, rows []map[string]any, batchSize int, debug bool, logger *log.Logger) error {
+// MySQL prepared statement 的參數上限
+const mysqlMaxPlaceholders = 65535
+
+// 批次 UPDATE：把這批要寫的值組成衍生表（SELECT ... UNION ALL SELECT ...），
+// 用一條 UPDATE ... JOIN 寫回（無插入路徑）；參數超過 MySQL 上限時分成多條，仍在呼叫方的同一個交易內。
+// 各筆要更新的欄位不一定相同（成功寫金額、失敗只寫 status/recompute_info），
+// 每個欄位帶一個旗標，旗標為 0 的保留原值；值本身可以是 NULL。
+// 只寫 status 與版本欄位（versionCol 非空時）仍等於讀取時的值（guards）的資料。
+func batchUpdate(ctx context.Context, db *gorm.DB, table, idCol, versionCol string, rows []map[string]any, guards map[uint64]rowGuard, logger *slog.Logger) error {
 	if len(rows) == 0 {
 		return nil
 	}
 
-	ids := make([]any, 0, len(rows))
-	cases := map[string][]string{}
-	colArgs := map[string][]any{}
-
+	// 固定欄位順序避免 map 無序
+	colSet := map[string]struct{}{}
 	for _, r := range rows {
-		id := r[idCol]
-		ids = append(ids, id)
-		for col, val := range r {
-			if col == idCol {
-				continue
+		for col := range r {
+			if col != idCol {
+				colSet[col] = struct{}{}
 			}
-			cases[col] = append(cases[col], "WHEN ? THEN ?")
-			colArgs[col] = append(colArgs[col], id, val) // 參數順序：id, val
 		}
 	}
-
-	// 固定欄位順序避免 map 無序
-	cols := make([]string, 0, len(cases))
-	for col := range cases {
+	cols := make([]string, 0, len(colSet))
+	for col := range colSet {
 		cols = append(cols, col)
 	}
 	sort.Strings(cols)
 
-	setClauses := make([]string, 0, len(cols))
-	args := []any{}
-	for _, col := range cols {
-		setClauses = append(setClauses,
-			fmt.Sprintf("`%s` = CASE `%s` %s ELSE `%s` END", col, idCol, strings.Join(cases[col], " "), col))
-		args = append(args, colArgs[col]...) // 同欄位的參數依序加入
+	// 每筆的參數：id、status、版本欄位 + 每個欄位的值（旗標是字面值，不佔參數）
+	chunk := max(1, mysqlMaxPlaceholders/(len(cols)+3))
+	for start := 0; start < len(rows); start += chunk {
+		part := rows[start:min(start+chunk, len(rows))]
+		sqlStr, args := batchUpdateSQL(table, idCol, versionCol, cols, part, guards)
+		// 檢查 ? 數與參數數一致
+		if strings.Count(sqlStr, "?") != len(args) {
+			return fmt.Errorf("batchUpdate: placeholder mismatch sql ?=%d args=%d", strings.Count(sqlStr, "?"), len(args))
+		}
+		logger.Debug("batch update", logKeyTable, table, "rows", len(part), "sql", sqlStr, "args", args)
+		if err := db.WithContext(ctx).Exec(sqlStr, args...).Error; err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	inPlaceholders := strings.TrimRight(strings.Repeat("?,", len(ids)), ",")
-	sqlStr := fmt.Sprintf("UPDATE `%s` SET %s WHERE `%s` IN (%s)",
-		table, strings.Join(setClauses, ", "), idCol, inPlaceholders)
-
-	// CASE 的參數在前，IN (...) 的 id 參數接在後
-	args = append(args, ids...)
-
-	// 檢查 ? 數與參數數一致
-	if strings.Count(sqlStr, "?") != len(args) {
-		return fmt.Errorf("batchUpdate: placeholder mismatch sql ?=%d args=%d", strings.Count(sqlStr, "?"), len(args))
+// 組出一條 UPDATE ... JOIN 與參數；cols 為已排序的更新欄位
+func batchUpdateSQL(table, idCol, versionCol string, cols []string, rows []map[string]any, guards map[uint64]rowGuard) (string, []any) {
+	// 衍生表欄位用編號命名（_id, _st, _ver, _v0, _f0, ...），不受業務欄位名影響
+	selects := make([]string, 0, len(rows))
+	args := make([]any, 0, len(rows)*(len(cols)+3))
+	for i, r := range rows {
+		g := guards[r[idCol].(uint64)]
+		parts := make([]string, 0, 2*len(cols)+3)
+		parts = append(parts, "?"+derivedAlias(i, "_id"), "?"+derivedAlias(i, "_st"))
+		args = append(args, r[idCol], g.Status)
+		if versionCol != "" {
+			parts = append(parts, "?"+derivedAlias(i, "_ver"))
+			args = append(args, g.Version)
+		}
+		for j, col := range cols {
+			val, ok := r[col]
+			flag := "0"
+			if ok {
+				flag = "1"
+			}
+			parts = append(parts, "?"+derivedAlias(i, fmt.Sprintf("_v%d", j)), flag+derivedAlias(i, fmt.Sprintf("_f%d", j)))
+			args = append(args, val)
+		}
+		selects = append(selects, "SELECT "+strings.Join(parts, ", "))
 	}
 
-	// 檢查批次長度
-	if len(ids) != batchSize {
-		logger.Printf("[WARN][%s] ids count %d != batchSize %d, ids=%v", table, len(ids), batchSize, ids)
-		return fmt.Errorf("batchUpdate: ids count %d != batchSize %d", len(ids), batchSize)
+	setClauses := make([]string, 0, len(cols))
+	for j, col := range cols {
+		setClauses = append(setClauses, fmt.Sprintf("t.`%s` = IF(s._f%d = 1, s._v%d, t.`%s`)", col, j, j, col))
 	}
+	where := "t.`status` = s._st"
+	if versionCol != "" {
+		where += fmt.Sprintf(" AND t.`%s` <=> s._ver", versionCol)
+	}
+	sqlStr := fmt.Sprintf("UPDATE `%s` t JOIN (%s) s ON t.`%s` = s._id SET %s WHERE %s",
+		table, strings.Join(selects, " UNION ALL "), idCol, strings.Join(setClauses, ", "), where)
+	return sqlStr, args
+}
 
-	if debug {
-		logger.Printf("[SQL][%s] %s | args=%v", table, sqlStr, args)
+// UNION ALL 的欄位名取第一個 SELECT，後面的不必再命名
+func derivedAlias(row int, name string) string {
+	if row > 0 {
+		return ""
 	}
-	return db.WithContext(ctx).Exec(sqlStr, args...).Error
+	return " AS " + name
 }
 
 // ---------- fetch IDs by batch ----------
@@ -731,11 +1081,57 @@ func fetchIDsAfterID(ctx context.Context, db *gorm.DB, tbl, idCol, whereSQL stri
 }
 
 // ---------- per-table loop ----------
-func handleTable(ctx context.Context, db *gorm.DB, table string, batchSize int, debug bool, logger *log.Logger) bool {
+
+// 各表處理共用的連線、匯率來源與設定
+type recomputeEnv struct {
+	DB         *gorm.DB
+	Rates      RateSource
+	Cfg        Config
+	Debug      bool
+	BaseLogger *slog.Logger
+	// 本次執行（daemon 單表的一輪、run-once / recompute 的一次呼叫）的識別碼與帶 run_id 的 logger，見 startRun
+	RunID  string
+	Logger *slog.Logger
+	// dry-run：跑完整個撈取/計算流程，但不寫回，改把差異寫進 Diff
+	DryRun bool
+	Diff   diffWriter
+	// daemon 主迴圈狀態（/healthz、/readyz）；非 daemon 為 nil
+	Health *healthState
+}
+
+// 一個批次的處理結果
+type batchStats struct {
+	Fetched   int // 本批 id 數
+	Converted int // 寫成 status=1
+	Failed    int // 仍為 status=2（缺辦公室、缺匯率…），含轉為 terminal_status 的
+	Terminal  int // 失敗次數用完，改為 retry.terminal_status
+	Missing   int // 撈不到（已被改成非 status=2 或已刪除）
+	Changed   int // dry-run：有欄位或狀態差異的筆數
+	Conflicts int // 寫回時 status 或版本欄位已被其他程式修改，略過不寫（不計入 Converted/Failed）
+}
+
+func (b *batchStats) add(o batchStats) {
+	b.Fetched += o.Fetched
+	b.Converted += o.Converted
+	b.Failed += o.Failed
+	b.Terminal += o.Terminal
+	b.Missing += o.Missing
+	b.Changed += o.Changed
+	b.Conflicts += o.Conflicts
+}
+
+// 一張表一輪的處理結果
+type tableResult struct {
+	batchStats
+	Batches int
+	Err     error // 最後一次 SQL 錯誤
+}
+
+// 取表對應並補預設值；sets 為實際要換算的金額欄位
+func tableMapping(table string) (FieldMapping, []AmountFieldSet, bool) {
 	mapping, ok := TableFieldMappings[table]
 	if !ok {
-		logger.Printf("[%s] mapping not found, skip", table)
-		return false
+		return mapping, nil, false
 	}
 	if mapping.IDColumn == "" {
 		mapping.IDColumn = "id"
@@ -744,184 +1140,585 @@ func handleTable(ctx context.Context, db *gorm.DB, table string, batchSize int,
 	if len(sets) == 0 {
 		sets = []AmountFieldSet{{Base: mapping.BaseAmount, Usdt: mapping.UsdtAmount, Cny: mapping.CnyAmount}}
 	}
-	logger.Printf("[debug-1][%s] sets len=%d sample=%+v", table, len(sets), sets)
+	return mapping, sets, true
+}
+
+func handleTable(ctx context.Context, env *recomputeEnv, table string) tableResult {
+	db, logger := env.DB, env.Logger
+	batchSize := env.Cfg.RecomputeBatchSize
+	res := tableResult{}
+	mapping, sets, ok := tableMapping(table)
+	if !ok {
+		logger.Warn("mapping not found, skip", logKeyTable, table)
+		return res
+	}
+	logger.Debug("amount sets", logKeyTable, table, "count", len(sets), "sets", sets)
 
 	lastID := uint64(0)
 	whereSQL := "status = 2"
-	if table != "acc_channel_info" {
+	if !mapping.OfficeOnly {
 		whereSQL += " AND entry_date IS NOT NULL AND currency IS NOT NULL AND currency <> ''"
 	}
-	anyProcessed := false
+	var whereArgs []any
+	if env.Cfg.Retry.Enabled {
+		retrySQL, retryArgs := retryFilter(table, mapping.IDColumn)
+		whereSQL += " AND " + retrySQL
+		whereArgs = retryArgs
+	}
 
-	for {
-		ids, err := fetchIDsAfterID(ctx, db, table, mapping.IDColumn, whereSQL, nil, batchSize, lastID)
+	// 下一批 id（keyset 依撈到的 id 往後推，與寫回結果無關）；沒有了回傳空
+	nextIDs := func() ([]uint64, error) {
+		stop := observeStage(table, stageFetchIDs)
+		ids, err := fetchIDsAfterID(ctx, db, table, mapping.IDColumn, whereSQL, whereArgs, batchSize, lastID)
+		stop()
 		if err != nil {
-			logger.Printf("[%s] fetch ids error: %v", table, err)
-			return true
+			logger.Error("fetch ids error", logKeyTable, table, "err", err)
+			return nil, err
 		}
-		if len(ids) == 0 {
-			return anyProcessed
+		if len(ids) > 0 {
+			lastID = ids[len(ids)-1]
+			logger.Info("batch", logKeyTable, table, "size", len(ids), logKeyBatchFrom, ids[0], logKeyBatchTo, lastID)
 		}
-		anyProcessed = true
-		lastID = ids[len(ids)-1]
-		logger.Printf("[%s] batch size=%d range=%d-%d", table, len(ids), ids[0], lastID)
-
-		// 預撈
-		recMap, err := fetchRecordsBatch(ctx, db, table, ids, mapping, sets)
-		if err != nil {
-			logger.Printf("[%s] fetch records batch error: %v", table, err)
-			continue
+		return ids, nil
+	}
+	write := func(pb *preparedBatch) {
+		res.Batches++
+		err := pb.Err
+		if err == nil {
+			err = writeBatch(ctx, env, table, mapping, pb)
 		}
-		siteMap, subMap, err := prefetchOffices(ctx, db, recMap)
+		res.add(pb.Stats)
 		if err != nil {
-			logger.Printf("[%s] prefetch offices error: %v", table, err)
-			continue
+			res.Err = err
 		}
-		rateMap, err := prefetchRates(ctx, db, recMap)
-		if err != nil {
-			logger.Printf("[%s] prefetch rates error: %v", table, err)
+		env.Health.tick()
+	}
+
+	// 不 pipeline：撈 -> 算 -> 寫 依序進行
+	if env.Cfg.PipelineDepth == 0 {
+		for ctx.Err() == nil { // 收到停止訊號：不再撈下一批
+			ids, err := nextIDs()
+			if err != nil {
+				res.Err = err
+				return res
+			}
+			if len(ids) == 0 {
+				return res
+			}
+			pb := prepareBatch(ctx, env, table, mapping, sets, ids, false)
+			write(&pb)
+		}
+		return res
+	}
+
+	// pipeline：背景先撈、先算下一批，這裡依序寫回；最多 pipeline_depth 批等著寫
+	batches := make(chan preparedBatch, env.Cfg.PipelineDepth-1)
+	var fetchErr error
+	go func() {
+		defer close(batches)
+		for ctx.Err() == nil {
+			ids, err := nextIDs()
+			if err != nil {
+				fetchErr = err
+				return
+			}
+			if len(ids) == 0 {
+				return
+			}
+			pb := prepareBatch(ctx, env, table, mapping, sets, ids, false)
+			select {
+			case batches <- pb:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for pb := range batches {
+		if ctx.Err() != nil {
+			// 收到停止訊號：還沒開始寫的批次直接丟掉，下次啟動會重新撈到
 			continue
 		}
+		write(&pb)
+	}
+	if fetchErr != nil { // channel 關閉後才讀，不會與背景 goroutine 競爭
+		res.Err = fetchErr
+	}
+	return res
+}
 
-		updatesBatch := make([]map[string]any, 0, len(ids))
-		updateCols := map[string]struct{}{}
+// 連線池大小；每個 worker 同一時間只用一條連線（開 pipeline 時兩條），另留一條給 /readyz、backlog COUNT
+const (
+	dbMaxOpenConns = 10
+	dbMaxIdleConns = 5
+	maxWorkers     = dbMaxOpenConns - 1
+)
 
-		for _, id := range ids {
-			rec, ok := recMap[id]
-			if !ok {
-				continue
+// run-once 的一輪：最多 cfg.Workers 張表同時處理，回傳結果與 tables 順序相同（daemon 見 pollTable）。
+// 單表 panic 只記為該表的錯誤；onDone 在各表完成時呼叫（可能並行）。
+func runPass(ctx context.Context, env *recomputeEnv, tables []string, onDone func(table string, res tableResult)) []tableResult {
+	results := make([]tableResult, len(tables))
+	sem := make(chan struct{}, env.Cfg.Workers)
+	var wg sync.WaitGroup
+	for i, tbl := range tables {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done(): // 還沒輪到就收到停止訊號
+				return
 			}
-			upd, reason := computeUpdateCached(mapping, sets, rec, siteMap, subMap, rateMap, table, logger)
-			if len(upd) == 0 {
-				logger.Printf("[recompute][%s][%d] skip: %s", table, id, reason)
-				continue
+			defer func() { <-sem }()
+			results[i] = handleTableSafe(ctx, env, tbl)
+			if onDone != nil {
+				onDone(tbl, results[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func handleTableSafe(ctx context.Context, env *recomputeEnv, table string) (res tableResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			env.Logger.Error("table panic", logKeyTable, table, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			res.Err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handleTable(ctx, env, table)
+}
+
+// 計算完成、等待寫回的一批
+type preparedBatch struct {
+	IDs       []uint64
+	Stats     batchStats
+	Updates   []map[string]any // 含 id 欄位；dry-run 時為空
+	Attempts  map[uint64]int   // 計算前的失敗次數（retry 啟用時）
+	Succeeded []uint64
+	Failed    map[uint64]string   // id -> recompute_info
+	Guards    map[uint64]rowGuard // 讀取時的 status / 版本欄位，寫回時比對
+	Audit     []auditRow          // audit 啟用時各筆變動的欄位
+	Err       error               // 預撈或寫 diff 失敗，整批不寫回
+}
+
+// 處理一批 id：預撈 -> 計算 -> 批次寫回。
+// force=false 只處理 status=2；force=true（recompute --force）不看 status。
+func processBatch(ctx context.Context, env *recomputeEnv, table string, mapping FieldMapping, sets []AmountFieldSet, ids []uint64, force bool) (batchStats, error) {
+	pb := prepareBatch(ctx, env, table, mapping, sets, ids, force)
+	if pb.Err != nil {
+		return pb.Stats, pb.Err
+	}
+	err := writeBatch(ctx, env, table, mapping, &pb)
+	return pb.Stats, err
+}
+
+// 預撈 + 計算；只讀 DB，可以和上一批的寫回同時進行
+func prepareBatch(ctx context.Context, env *recomputeEnv, table string, mapping FieldMapping, sets []AmountFieldSet, ids []uint64, force bool) preparedBatch {
+	db := env.DB
+	logger := env.Logger.With(logKeyTable, table, logKeyBatchFrom, ids[0], logKeyBatchTo, ids[len(ids)-1])
+	pb := preparedBatch{IDs: ids, Stats: batchStats{Fetched: len(ids)}}
+	st := &pb.Stats
+	fail := func(what string, err error) preparedBatch {
+		logger.Error(what+" error", "err", err)
+		pb.Err = err
+		return pb
+	}
+
+	// 預撈
+	metricFetched.WithLabelValues(table).Add(float64(len(ids)))
+	stop := observeStage(table, stageFetchRecords)
+	recMap, err := fetchRecordsBatch(ctx, db, table, ids, mapping, sets, !force)
+	stop()
+	if err != nil {
+		return fail("fetch records batch", err)
+	}
+	stop = observeStage(table, stagePrefetchOffices)
+	siteMap, subMap, err := prefetchOffices(ctx, db, recMap)
+	stop()
+	if err != nil {
+		return fail("prefetch offices", err)
+	}
+	stop = observeStage(table, stagePrefetchRates)
+	rc, err := prefetchRates(ctx, env.Rates, recMap, env.Cfg.Rates)
+	stop()
+	if err != nil {
+		return fail("prefetch rates", err)
+	}
+	retry := env.Cfg.Retry
+	pb.Attempts = map[uint64]int{}
+	if retry.Enabled {
+		if pb.Attempts, err = loadRetryAttempts(ctx, db, table, ids); err != nil {
+			return fail("load retry attempts", err)
+		}
+	}
+	attempts := pb.Attempts
+
+	pb.Updates = make([]map[string]any, 0, len(ids))
+	pb.Succeeded = make([]uint64, 0, len(ids))
+	pb.Failed = map[uint64]string{}
+	pb.Guards = map[uint64]rowGuard{}
+
+	for _, id := range ids {
+		rec, ok := recMap[id]
+		if !ok {
+			st.Missing++
+			continue
+		}
+		var trace *computeTrace
+		if env.Cfg.Audit && !env.DryRun {
+			trace = &computeTrace{}
+		}
+		upd, reason := computeUpdateCached(mapping, sets, rec, siteMap, subMap, rc, env.Cfg.Rounding, table, logger, trace)
+		if len(upd) == 0 {
+			logger.Info("skip", logKeyID, id, logKeyReasonCode, reasonCode(reason), "reason", reason)
+			continue
+		}
+		if upd["status"] == 1 {
+			st.Converted++
+			pb.Succeeded = append(pb.Succeeded, id)
+		} else {
+			st.Failed++
+			pb.Failed[id] = reason
+			logger.Info("record failed", logKeyID, id, logKeyReasonCode, reasonCode(reason), "reason", reason)
+			if retry.exhausted(attempts[id] + 1) {
+				// 失敗次數用完：改成 terminal_status，保留 recompute_info，不再輪詢
+				upd["status"] = retry.TerminalStatus
+				st.Terminal++
+				logger.Warn("max attempts reached, moved to terminal status", logKeyID, id, "attempts", attempts[id]+1,
+					"status", retry.TerminalStatus, logKeyReasonCode, reasonCode(reason), "reason", reason)
 			}
-			upd[mapping.IDColumn] = id
-			updatesBatch = append(updatesBatch, upd)
-			for k := range upd {
-				if k != mapping.IDColumn {
-					updateCols[k] = struct{}{}
+		}
+		if env.DryRun {
+			if diffs := diffUpdate(table, rec, upd); len(diffs) > 0 {
+				st.Changed++
+				if err := env.Diff.Write(diffs); err != nil {
+					pb.Err = fmt.Errorf("write diff: %w", err)
+					return pb
 				}
 			}
+			continue
 		}
+		if trace != nil {
+			pb.Audit = append(pb.Audit, auditRows(env.RunID, table, mapping, rec, upd, trace)...)
+		}
+		upd[mapping.IDColumn] = id
+		pb.Updates = append(pb.Updates, upd)
+		pb.Guards[id] = rowGuard{Status: rec.Status, Version: rec.Version}
+	}
+	return pb
+}
 
-		if len(updatesBatch) == 0 {
-			continue
+// 寫回一批；成功（或 dry-run 無需寫回）後才計入 converted/failed 指標
+func writeBatch(ctx context.Context, env *recomputeEnv, table string, mapping FieldMapping, pb *preparedBatch) error {
+	db := env.DB
+	logger := env.Logger.With(logKeyTable, table, logKeyBatchFrom, pb.IDs[0], logKeyBatchTo, pb.IDs[len(pb.IDs)-1])
+	retry := env.Cfg.Retry
+
+	if len(pb.Updates) == 0 {
+		countBatchMetrics(table, pb)
+		return nil
+	}
+
+	// 快車道
+	// err = db.Table(table).
+	// 	Clauses(clause.OnConflict{
+	// 		Columns:   []clause.Column{{Name: mapping.IDColumn}},
+	// 		DoUpdates: clause.AssignmentColumns(mapKeys(updateCols)),
+	// 	}).
+	// 	Create(updatesBatch).Error
+
+	// if err != nil {
+	// 	logger.Printf("[recompute][%s] fast-path failed: %v, fallback to per-row", table, err)
+	// 	for _, row := range updatesBatch { // 慢車道
+	// 		id := row[mapping.IDColumn]
+	// 		delete(row, mapping.IDColumn)
+	// 		res := db.Table(table).Where(fmt.Sprintf("%s = ? AND status = 2", mapping.IDColumn), id).Updates(row)
+	// 		if res.Error != nil {
+	// 			logger.Printf("[recompute][%s][%v] slow-path error: %v", table, id, res.Error)
+	// 		}
+	// 	}
+	// }
+
+	// 快車道：批次 UPDATE（無插入路徑）
+	// err = batchUpdate(ctx, db, table, mapping.IDColumn, updatesBatch)
+	//0204 加入 sql log
+	// err = batchUpdate(ctx, db, table, mapping.IDColumn, updatesBatch, logger)
+	// 寫回與重試紀錄放在同一個交易；收到停止訊號時仍會做完（或逾時 rollback），不會只寫一半
+	wctx, cancelWrite := writeContext(ctx)
+	defer cancelWrite()
+	stop := observeStage(table, stageUpdate)
+	var wr writeResult
+	var err error
+	for attempt := 1; ; attempt++ {
+		// 交易內會從這批移除衝突／失敗的 id，重來時要從原本的內容開始
+		work := pb.clone()
+		err = db.WithContext(wctx).Transaction(func(tx *gorm.DB) error {
+			var txErr error
+			wr, txErr = writeBatchTx(wctx, tx, table, mapping, retry, &work, logger)
+			return txErr
+		})
+		if err == nil {
+			*pb = work
+			break
+		}
+		if !isLockError(err) || attempt > writeLockRetries || wctx.Err() != nil {
+			break
 		}
+		logger.Warn("update transaction hit lock error, retrying", "attempt", attempt, "err", err)
+		select {
+		case <-time.After(time.Duration(attempt) * writeLockBackoff):
+		case <-wctx.Done():
+		}
+	}
+	stop()
+	if err != nil {
+		logger.Error("update transaction rolled back", "err", err)
+		return err
+	}
+	if len(wr.conflicts) > 0 {
+		logger.Warn("skipped rows modified concurrently", "count", len(wr.conflicts), "ids", wr.conflicts)
+		metricConflicts.WithLabelValues(table).Add(float64(len(wr.conflicts)))
+	}
+	countBatchMetrics(table, pb)
+	metricUpdateRows.WithLabelValues(table, "fast").Add(float64(wr.fastRows))
+	metricUpdateRows.WithLabelValues(table, "slow").Add(float64(wr.slowRows))
+	if ctx.Err() != nil {
+		logger.Info("batch written after shutdown signal", "rows", wr.fastRows+wr.slowRows)
+	}
+	return wr.rowErr
+}
 
-		// 快車道
-		// err = db.Table(table).
-		// 	Clauses(clause.OnConflict{
-		// 		Columns:   []clause.Column{{Name: mapping.IDColumn}},
-		// 		DoUpdates: clause.AssignmentColumns(mapKeys(updateCols)),
-		// 	}).
-		// 	Create(updatesBatch).Error
-
-		// if err != nil {
-		// 	logger.Printf("[recompute][%s] fast-path failed: %v, fallback to per-row", table, err)
-		// 	for _, row := range updatesBatch { // 慢車道
-		// 		id := row[mapping.IDColumn]
-		// 		delete(row, mapping.IDColumn)
-		// 		res := db.Table(table).Where(fmt.Sprintf("%s = ? AND status = 2", mapping.IDColumn), id).Updates(row)
-		// 		if res.Error != nil {
-		// 			logger.Printf("[recompute][%s][%v] slow-path error: %v", table, id, res.Error)
-		// 		}
-		// 	}
-		// }
+// deadlock / lock wait timeout 時整個寫回交易最多再重來幾次，每次多等 writeLockBackoff
+const (
+	writeLockRetries = 3
+	writeLockBackoff = 200 * time.Millisecond
+)
 
-		// 快車道：批次 UPDATE（無插入路徑）
-		// err = batchUpdate(ctx, db, table, mapping.IDColumn, updatesBatch)
-		//0204 加入 sql log
-		// err = batchUpdate(ctx, db, table, mapping.IDColumn, updatesBatch, logger)
-		err = batchUpdate(ctx, db, table, mapping.IDColumn, updatesBatch, batchSize, debug, logger)
+// 一次寫回交易的結果
+type writeResult struct {
+	fastRows, slowRows int
+	conflicts          []uint64 // 鎖定比對或慢車道發現已被修改的 id
+	rowErr             error    // 慢車道個別失敗不 rollback 其他筆，與原本逐筆更新的行為一致
+}
 
-		if err != nil {
-			logger.Printf("[recompute][%s] batch update failed: %v, fallback to per-row", table, err)
-			for _, row := range updatesBatch { // 慢車道
-				id := row[mapping.IDColumn]
-				delete(row, mapping.IDColumn)
-				res := db.Table(table).Where(fmt.Sprintf("%s = ? AND status = 2", mapping.IDColumn), id).Updates(row)
-				if res.Error != nil {
-					logger.Printf("[recompute][%s][%v] slow-path error: %v", table, id, res.Error)
+// 交易內：鎖定比對 -> 快車道（失敗改慢車道）-> 稽核 -> 重試紀錄。
+// 寫不進去的 id 會從 pb 移除，回傳 error 時整個交易 rollback。
+func writeBatchTx(ctx context.Context, tx *gorm.DB, table string, mapping FieldMapping, retry RetryConfig, pb *preparedBatch, logger *slog.Logger) (writeResult, error) {
+	var wr writeResult
+	versionCol := mapping.versionColumn()
+	conflicts, err := lockAndCompare(ctx, tx, table, mapping, pb.Guards)
+	if err != nil {
+		logger.Error("lock rows error", "err", err)
+		return wr, err
+	}
+	if len(conflicts) > 0 {
+		pb.dropConflicts(conflicts, mapping.IDColumn, retry.TerminalStatus)
+		wr.conflicts = conflicts
+	}
+	if err := batchUpdate(ctx, tx, table, mapping.IDColumn, versionCol, pb.Updates, pb.Guards, logger); err == nil {
+		wr.fastRows = len(pb.Updates)
+	} else if isLockError(err) {
+		// 交易已被 MySQL rollback，慢車道也寫不進去，交給外層重來
+		return wr, err
+	} else {
+		logger.Warn("batch update failed, fallback to per-row", "err", err)
+		// 與快車道相同的 compare-and-set 條件；force 時讀取的 status 不一定是 2
+		where := fmt.Sprintf("`%s` = ? AND status = ?", mapping.IDColumn)
+		if versionCol != "" {
+			where += fmt.Sprintf(" AND `%s` <=> ?", versionCol)
+		}
+		var failed, lost []uint64
+		for _, row := range pb.Updates { // 慢車道
+			id := row[mapping.IDColumn].(uint64)
+			set := maps.Clone(row)
+			delete(set, mapping.IDColumn)
+			g := pb.Guards[id]
+			args := []any{id, g.Status}
+			if versionCol != "" {
+				args = append(args, g.Version)
+			}
+			res := tx.Table(table).Where(where, args...).Updates(set)
+			if res.Error != nil {
+				if isLockError(res.Error) {
+					return wr, res.Error
 				}
+				logger.Error("slow-path error", logKeyID, id, "err", res.Error)
+				wr.rowErr = res.Error
+				failed = append(failed, id)
+				continue
 			}
+			if res.RowsAffected == 0 {
+				// 值完全沒變時 MySQL 也回 0，要再確認條件是否仍成立
+				ok, err := stillGuarded(ctx, tx, table, mapping, id, g)
+				if err != nil {
+					logger.Error("recheck row error", logKeyID, id, "err", err)
+					return wr, err
+				}
+				if !ok {
+					lost = append(lost, id)
+					continue
+				}
+			}
+			wr.slowRows++
+		}
+		if len(lost) > 0 {
+			pb.dropConflicts(lost, mapping.IDColumn, retry.TerminalStatus)
+			wr.conflicts = append(wr.conflicts, lost...)
+		}
+		if len(failed) > 0 {
+			pb.dropRows(failed, mapping.IDColumn, retry.TerminalStatus)
 		}
+	}
+	if len(pb.Audit) > 0 {
+		if err := insertAudit(ctx, tx, pb.Audit); err != nil {
+			logger.Error("insert audit error", "err", err)
+			return wr, err
+		}
+	}
+	if retry.Enabled {
+		// 只記錄實際寫回的 id；慢車道失敗的下一輪會重新撈到
+		if err := recordRetries(ctx, tx, retry, table, pb.Attempts, pb.Succeeded, pb.Failed, logger); err != nil {
+			logger.Error("record retries error", "err", err)
+			return wr, err
+		}
+	}
+	return wr, nil
+}
 
+func countBatchMetrics(table string, pb *preparedBatch) {
+	metricConverted.WithLabelValues(table).Add(float64(len(pb.Succeeded)))
+	for _, reason := range pb.Failed {
+		metricFailed.WithLabelValues(table, reasonCode(reason)).Inc()
+	}
+}
+
+// 收到停止訊號後給寫回的寬限時間，逾時就取消並 rollback
+const writeGrace = 20 * time.Second
+
+// 寫回用的 context：不跟著 ctx 立即取消，ctx 取消後 writeGrace 才取消
+func writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	wctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stopAfter := context.AfterFunc(ctx, func() {
+		t := time.AfterFunc(writeGrace, cancel)
+		context.AfterFunc(wctx, func() { t.Stop() })
+	})
+	return wctx, func() {
+		stopAfter()
+		cancel()
 	}
 }
 
 // ---------- main ----------
 
-func main() {
-	cfg, err := loadConfig("config.yaml")
+// 組好共用依賴：logger、DB、表對應、schema 檢查、匯率來源
+func newRecomputeEnv(ctx context.Context, configPath string) (*recomputeEnv, error) {
+	cfg, err := loadConfig(configPath)
 	if err != nil {
-		fmt.Println("load config error:", err)
-		return
+		return nil, fmt.Errorf("load config error: %w", err)
+	}
+	logger := newLogger(cfg.Dirs.Logs, cfg.Level)
+	slog.SetDefault(logger) // 讓 slog.Debug / log.Printf 也寫進同一個檔案
+	fail := func(format string, args ...any) (*recomputeEnv, error) {
+		err := fmt.Errorf(format, args...)
+		logger.Error(err.Error())
+		return nil, err
 	}
-	logger := newLogger(cfg.Dirs.Logs)
-	log.SetOutput(logger.Writer()) // 讓 log.Printf 也寫進同一個檔案
 
-	logger.Printf("start recompute batch_size=%d", cfg.RecomputeBatchSize)
+	logger.Info("start recompute", "config", configPath, "mode", cfg.Mode, "log_level", cfg.Level.String())
+	logger.Info("start recompute", "batch_size", cfg.RecomputeBatchSize, "workers", cfg.Workers, "rate_lookback_days", cfg.Rates.LookbackDays,
+		"rate_pivots", cfg.Rates.Pivots, "rate_resolve_order", cfg.Rates.ResolveOrder)
 
 	// 載入 config 後
 	debug := cfg.IsDebug == 1
 
-	db, err := gorm.Open(mysql.Open(cfg.Database.Development.DSN), &gorm.Config{
-		Logger: glogger.Default.LogMode(
-			func() glogger.LogLevel {
-				if debug {
-					return glogger.Info // 印 SQL
-				}
-				return glogger.Silent // 不印 SQL
-			}()),
+	mappings, order, mappingSrc, err := loadTableMappings(cfg)
+	if err != nil {
+		return fail("table mappings error: %v", err)
+	}
+	TableFieldMappings, TableOrder = mappings, order
+	logger.Info("table mappings", "source", mappingSrc, "tables", TableOrder)
+
+	db, err := gorm.Open(mysql.Open(cfg.DB.DSN), &gorm.Config{
+		Logger: newGormLogger(logger, debug),
 	})
 
 	if err != nil {
-		logger.Printf("db connect error: %v", err)
-		return
+		return fail("db connect error: %v", err)
 	}
 
-	ctx := context.Background()
-
 	/* 2024-02-09 Fix connection leak: Start */
 	sqlDB, err := db.DB()
 	if err != nil {
-		logger.Printf("get sql.DB error: %v", err)
-		return
+		return fail("get sql.DB error: %v", err)
 	}
 	// 設定連線池限制，避免長期佔用造成 500 error
-	sqlDB.SetMaxIdleConns(5)
-	sqlDB.SetMaxOpenConns(10)
+	sqlDB.SetMaxIdleConns(dbMaxIdleConns)
+	sqlDB.SetMaxOpenConns(dbMaxOpenConns)
 	sqlDB.SetConnMaxLifetime(time.Hour)
 	/* 2024-02-09 Fix connection leak: End */
 
-	tables := []string{
-		"acc_cashbook",
-		"acc_expenses",
-		"acc_borrow_lend",
-		"acc_recharge_withdraw",
-		"acc_channel_info",
-		"acc_ad_performance_analysis",
-		"acc_balance_sheet",
-		"acc_revenue_expense_adjustments",
-		"acc_operational_information",
-	}
-
-	for {
-		anyPending := false
-		for _, tbl := range tables {
-			time.Sleep(time.Second)
-			if handleTable(ctx, db, tbl, cfg.RecomputeBatchSize, debug, logger) {
-				anyPending = true
-			}
+	// auto_discover、版本欄位偵測都要用到 schema，schema_check=off 時仍讀取
+	schema, err := loadTableColumns(ctx, db, TableOrder)
+	if err != nil {
+		return fail("read information_schema error: %v", err)
+	}
+	if err := applyAutoDiscover(schema, TableFieldMappings, TableOrder, logger); err != nil {
+		return fail("%v", err)
+	}
+	detectVersionColumns(schema, TableFieldMappings, TableOrder, logger)
+	// 先套用欄位捨入規則，schema 檢查要比對最終的 places 與欄位小數位數
+	if err := applyRoundingOverrides(cfg.Rounding, TableFieldMappings); err != nil {
+		return fail("rounding config error: %v", err)
+	}
+	TableOrder, err = validateSchema(schema, TableFieldMappings, TableOrder, cfg.SchemaCheck, cfg.Rounding, logger)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	logger.Info("rounding", "currency", "default", "rule", roundingFor(cfg.Rounding, FieldMapping{}, "", "").String())
+	for cur := range cfg.Rounding.Currencies {
+		logger.Info("rounding", "currency", cur, "rule", roundingFor(cfg.Rounding, FieldMapping{}, "", cur).String())
+	}
 
+	if cfg.Audit {
+		if err := ensureAuditTable(ctx, db); err != nil {
+			return fail("create %s error: %v", auditTable, err)
 		}
-		now := time.Now().UTC().Format(time.RFC3339)
-		if !anyPending {
-			logger.Printf("[HEARTBEAT] %s tables=all status=idle", now)
-			time.Sleep(30 * time.Second)
-		} else {
-			logger.Printf("[HEARTBEAT] %s tables=all status=pending", now)
+		logger.Info("audit enabled", "table", auditTable)
+	}
+	if cfg.Retry.Enabled {
+		if err := ensureRetryTable(ctx, db); err != nil {
+			return fail("create %s error: %v", retryTable, err)
 		}
+		logger.Info("retry backoff enabled", "base_delay", cfg.Retry.BaseDelay.String(), "max_delay", cfg.Retry.MaxDelay.String(),
+			"max_attempts", cfg.Retry.MaxAttempts, "terminal_status", cfg.Retry.TerminalStatus)
+	}
+
+	rateSrc, err := newRateSource(cfg.Rates, db)
+	if err != nil {
+		return fail("rate source error: %v", err)
 	}
+	logger.Info("rate source", "name", rateSrc.Name())
+
+	env := &recomputeEnv{DB: db, Rates: rateSrc, Cfg: cfg, Debug: debug, BaseLogger: logger}
+	env.startRun()
+	return env, nil
+}
+
+// 開始新的一次執行：換新的 run_id，之後的 log 都帶這個欄位
+func (e *recomputeEnv) startRun() {
+	e.RunID = newRunID()
+	e.Logger = e.BaseLogger.With(logKeyRunID, e.RunID)
+}
+
+// 複製一份並換上新的 run_id；daemon 各表同時在跑，每一輪各用一份，不互相覆蓋
+func (e *recomputeEnv) newRun() *recomputeEnv {
+	c := *e
+	c.startRun()
+	return &c
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
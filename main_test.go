@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func testDate(s string) time.Time {
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func testRates(opts RateConfig, recs ...rateRecord) *rateCache {
+	if len(opts.ResolveOrder) == 0 {
+		opts.ResolveOrder = []string{rateDirect}
+	}
+	rc := &rateCache{rates: map[rateKey]decimal.Decimal{}, opts: opts}
+	for _, r := range recs {
+		rc.rates[rateKey{Date: r.Date, From: r.From, To: r.To}] = r.Rate
+	}
+	return rc
+}
+
+func rate(date, from, to, v string) rateRecord {
+	return rateRecord{Date: date, From: from, To: to, Rate: decimal.RequireFromString(v)}
+}
+
+// ---------- 匯率查詢 ----------
+
+func TestLookupRateCached(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    RateConfig
+		recs    []rateRecord
+		date    string
+		from    string
+		to      string
+		want    string // 匯率
+		wantHit rateHit
+		wantErr string
+	}{
+		{
+			name: "same currency",
+			date: "2024-01-05", from: "cny", to: " CNY ",
+			want: "1", wantHit: rateHit{Date: "2024-01-05", Direction: rateDirect},
+		},
+		{
+			name: "direct same day",
+			recs: []rateRecord{rate("2024-01-05", "PHP", "CNY", "0.128")},
+			date: "2024-01-05", from: "php", to: "cny",
+			want: "0.128", wantHit: rateHit{Date: "2024-01-05", Direction: rateDirect},
+		},
+		{
+			name: "no lookback uses only entry date",
+			recs: []rateRecord{rate("2024-01-04", "PHP", "CNY", "0.128")},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			wantErr: "no rate for 2024-01-05 PHP->CNY",
+		},
+		{
+			name: "lookback takes newest within window",
+			opts: RateConfig{LookbackDays: 3},
+			recs: []rateRecord{
+				rate("2024-01-02", "PHP", "CNY", "0.127"),
+				rate("2024-01-03", "PHP", "CNY", "0.128"),
+				rate("2024-01-06", "PHP", "CNY", "0.130"), // entry_date 之後的不用
+			},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			want: "0.128", wantHit: rateHit{Date: "2024-01-03", Direction: rateDirect},
+		},
+		{
+			name: "lookback window edge",
+			opts: RateConfig{LookbackDays: 2},
+			recs: []rateRecord{rate("2024-01-02", "PHP", "CNY", "0.127")},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			wantErr: "within 2 days",
+		},
+		{
+			name: "pivot through CNY",
+			opts: RateConfig{LookbackDays: 3, Pivots: []string{"CNY"}},
+			recs: []rateRecord{
+				rate("2024-01-05", "PHP", "CNY", "0.128"),
+				rate("2024-01-04", "CNY", "USDT", "0.14"),
+			},
+			date: "2024-01-05", from: "PHP", to: "USDT",
+			want:    "0.01792",
+			wantHit: rateHit{Date: "2024-01-04", Path: "PHP->CNY->USDT", Direction: rateDirect},
+		},
+		{
+			name: "direct preferred over pivot",
+			opts: RateConfig{Pivots: []string{"CNY"}},
+			recs: []rateRecord{
+				rate("2024-01-05", "PHP", "USDT", "0.018"),
+				rate("2024-01-05", "PHP", "CNY", "0.128"),
+				rate("2024-01-05", "CNY", "USDT", "0.14"),
+			},
+			date: "2024-01-05", from: "PHP", to: "USDT",
+			want: "0.018", wantHit: rateHit{Date: "2024-01-05", Direction: rateDirect},
+		},
+		{
+			name: "pivot missing second leg",
+			opts: RateConfig{Pivots: []string{"CNY"}},
+			recs: []rateRecord{rate("2024-01-05", "PHP", "CNY", "0.128")},
+			date: "2024-01-05", from: "PHP", to: "USDT",
+			wantErr: "(pivots CNY)",
+		},
+		{
+			name: "inverse rounds to 16 places",
+			opts: RateConfig{ResolveOrder: []string{rateDirect, rateInverse}},
+			recs: []rateRecord{rate("2024-01-05", "CNY", "PHP", "3")},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			want: "0.3333333333333333", wantHit: rateHit{Date: "2024-01-05", Direction: rateInverse},
+		},
+		{
+			name: "inverse not allowed by default",
+			recs: []rateRecord{rate("2024-01-05", "CNY", "PHP", "3")},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			wantErr: "no rate",
+		},
+		{
+			name: "zero rate is not inverted",
+			opts: RateConfig{ResolveOrder: []string{rateInverse}},
+			recs: []rateRecord{rate("2024-01-05", "CNY", "PHP", "0")},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			wantErr: "no rate",
+		},
+		{
+			name: "resolve_order direct first",
+			opts: RateConfig{ResolveOrder: []string{rateDirect, rateInverse}},
+			recs: []rateRecord{
+				rate("2024-01-05", "PHP", "CNY", "0.128"),
+				rate("2024-01-05", "CNY", "PHP", "8"),
+			},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			want: "0.128", wantHit: rateHit{Date: "2024-01-05", Direction: rateDirect},
+		},
+		{
+			name: "resolve_order inverse first",
+			opts: RateConfig{ResolveOrder: []string{rateInverse, rateDirect}},
+			recs: []rateRecord{
+				rate("2024-01-05", "PHP", "CNY", "0.128"),
+				rate("2024-01-05", "CNY", "PHP", "8"),
+			},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			want: "0.125", wantHit: rateHit{Date: "2024-01-05", Direction: rateInverse},
+		},
+		{
+			name: "newer date wins over resolve_order",
+			opts: RateConfig{LookbackDays: 3, ResolveOrder: []string{rateDirect, rateInverse}},
+			recs: []rateRecord{
+				rate("2024-01-04", "PHP", "CNY", "0.128"),
+				rate("2024-01-05", "CNY", "PHP", "8"),
+			},
+			date: "2024-01-05", from: "PHP", to: "CNY",
+			want: "0.125", wantHit: rateHit{Date: "2024-01-05", Direction: rateInverse},
+		},
+		{
+			name: "pivot with inverse leg",
+			opts: RateConfig{Pivots: []string{"CNY"}, ResolveOrder: []string{rateDirect, rateInverse}},
+			recs: []rateRecord{
+				rate("2024-01-05", "PHP", "CNY", "0.128"),
+				rate("2024-01-05", "USDT", "CNY", "8"),
+			},
+			date: "2024-01-05", from: "PHP", to: "USDT",
+			want:    "0.016",
+			wantHit: rateHit{Date: "2024-01-05", Path: "PHP->CNY->USDT", Direction: rateInverse},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := testRates(tt.opts, tt.recs...)
+			hit, err := lookupRateCached(rc, testDate(tt.date), tt.from, tt.to)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !hit.Rate.Equal(decimal.RequireFromString(tt.want)) {
+				t.Errorf("rate = %s, want %s", hit.Rate, tt.want)
+			}
+			hit.Rate = decimal.Decimal{}
+			if hit != tt.wantHit {
+				t.Errorf("hit = %+v, want %+v", hit, tt.wantHit)
+			}
+		})
+	}
+}
+
+func TestLookupLeg(t *testing.T) {
+	rc := testRates(RateConfig{LookbackDays: 1, ResolveOrder: []string{rateInverse}},
+		rate("2024-01-04", "CNY", "PHP", "7"),
+		rate("2024-01-05", "PHP", "CNY", "0.128"),
+	)
+	tests := []struct {
+		name     string
+		date     string
+		from, to string
+		want     string
+		wantDate string
+		wantOK   bool
+	}{
+		{name: "inverse only ignores direct", date: "2024-01-05", from: "PHP", to: "CNY", want: "0.1428571428571429", wantDate: "2024-01-04", wantOK: true},
+		{name: "other direction", date: "2024-01-05", from: "CNY", to: "PHP", want: "7.8125", wantDate: "2024-01-05", wantOK: true},
+		{name: "outside window", date: "2024-01-06", from: "PHP", to: "CNY", wantOK: false},
+		{name: "legs are not normalised", date: "2024-01-05", from: "php", to: "cny", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hit, ok := rc.lookupLeg(testDate(tt.date), tt.from, tt.to)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if !hit.Rate.Equal(decimal.RequireFromString(tt.want)) || hit.Date != tt.wantDate || hit.Direction != rateInverse {
+				t.Errorf("hit = %+v (rate %s), want rate %s date %s inverse", hit, hit.Rate, tt.want, tt.wantDate)
+			}
+		})
+	}
+}
+
+// 匯率備註的格式（成功換算時記進 info log）
+func TestRateNote(t *testing.T) {
+	tests := []struct {
+		name string
+		hit  rateHit
+		want string
+	}{
+		{name: "plain direct", hit: rateHit{Date: "2024-01-05", Direction: rateDirect}, want: ""},
+		{name: "fallback date", hit: rateHit{Date: "2024-01-03", Direction: rateDirect}, want: "PHP->USDT rate_date=2024-01-03"},
+		{name: "inverse", hit: rateHit{Date: "2024-01-05", Direction: rateInverse}, want: "PHP->USDT direction=inverse"},
+		{
+			name: "pivot fallback inverse",
+			hit:  rateHit{Date: "2024-01-04", Path: "PHP->CNY->USDT", Direction: rateInverse},
+			want: "PHP->USDT path=PHP->CNY->USDT rate_date=2024-01-04 direction=inverse",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rateNote(testDate("2024-01-05"), "PHP", "USDT", tt.hit); got != tt.want {
+				t.Errorf("rateNote = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 成功換算時備註以 info 記進 log，recompute_info 保持 NULL；失敗時不記備註
+func TestComputeUpdateLogsRateNote(t *testing.T) {
+	rc := testRates(RateConfig{LookbackDays: 3, Pivots: []string{"CNY"}},
+		rate("2024-01-05", "PHP", "CNY", "0.128"),
+		rate("2024-01-04", "CNY", "USDT", "0.14"),
+		rate("2024-01-05", "USDT", "CNY", "7.1"),
+	)
+	sets := []AmountFieldSet{{Base: "amount", Usdt: "amount_usdt", Cny: "amount_cny"}}
+	tests := []struct {
+		name       string
+		currency   string
+		wantStatus int
+		wantInfo   any
+		wantNote   string // 空字串代表不應有 rate_note 的 log
+	}{
+		{
+			name: "pivot and fallback date", currency: "PHP", wantStatus: 1, wantInfo: nil,
+			wantNote: "PHP->USDT path=PHP->CNY->USDT rate_date=2024-01-04",
+		},
+		{name: "no note for direct same-day rate", currency: "USDT", wantStatus: 1, wantInfo: nil},
+		{name: "failure keeps reason", currency: "VND", wantStatus: 2, wantInfo: "lookupRate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+			rec := recordRow{
+				ID:        7,
+				Currency:  sql.NullString{String: tt.currency, Valid: true},
+				EntryDate: sql.NullTime{Time: testDate("2024-01-05"), Valid: true},
+				Amounts:   map[string]decimal.NullDecimal{"amount": decimal.NewNullDecimal(decimal.NewFromInt(100))},
+			}
+			upd, _ := computeUpdateCached(FieldMapping{}, sets, rec, nil, nil, rc, RoundingConfig{}, "acc_expenses", logger, nil)
+			if upd["status"] != tt.wantStatus {
+				t.Errorf("status = %v, want %v", upd["status"], tt.wantStatus)
+			}
+			if want, ok := tt.wantInfo.(string); ok {
+				if got, _ := upd["recompute_info"].(string); !strings.Contains(got, want) {
+					t.Errorf("recompute_info = %v, want containing %q", upd["recompute_info"], want)
+				}
+			} else if upd["recompute_info"] != nil {
+				t.Errorf("recompute_info = %v, want NULL", upd["recompute_info"])
+			}
+			logged := buf.String()
+			if tt.wantNote == "" {
+				if strings.Contains(logged, "rate_note") {
+					t.Errorf("unexpected rate note log: %s", logged)
+				}
+				return
+			}
+			if !strings.Contains(logged, `"level":"INFO"`) || !strings.Contains(logged, `"rate_note":"`+tt.wantNote+`"`) {
+				t.Errorf("log = %s, want info line with rate_note %q", logged, tt.wantNote)
+			}
+		})
+	}
+}
+
+// ---------- 批次 UPDATE ----------
+
+func TestBatchUpdateSQL(t *testing.T) {
+	rows := []map[string]any{
+		{"id": uint64(1), "amount_cny": "8.64", "status": 1, "recompute_info": nil},
+		{"id": uint64(2), "status": 2, "recompute_info": "no rate"},
+	}
+	guards := map[uint64]rowGuard{1: {Status: 2, Version: int64(5)}, 2: {Status: 2, Version: int64(9)}}
+	cols := []string{"amount_cny", "recompute_info", "status"}
+
+	tests := []struct {
+		name       string
+		versionCol string
+		wantSQL    string
+		wantArgs   []any
+	}{
+		{
+			name: "status guard only",
+			wantSQL: "UPDATE `acc_expenses` t JOIN (" +
+				"SELECT ? AS _id, ? AS _st, ? AS _v0, 1 AS _f0, ? AS _v1, 1 AS _f1, ? AS _v2, 1 AS _f2" +
+				" UNION ALL SELECT ?, ?, ?, 0, ?, 1, ?, 1" +
+				") s ON t.`id` = s._id SET " +
+				"t.`amount_cny` = IF(s._f0 = 1, s._v0, t.`amount_cny`), " +
+				"t.`recompute_info` = IF(s._f1 = 1, s._v1, t.`recompute_info`), " +
+				"t.`status` = IF(s._f2 = 1, s._v2, t.`status`) " +
+				"WHERE t.`status` = s._st",
+			wantArgs: []any{uint64(1), 2, "8.64", nil, 1, uint64(2), 2, nil, "no rate", 2},
+		},
+		{
+			name:       "with version column",
+			versionCol: "updated_at",
+			wantSQL: "UPDATE `acc_expenses` t JOIN (" +
+				"SELECT ? AS _id, ? AS _st, ? AS _ver, ? AS _v0, 1 AS _f0, ? AS _v1, 1 AS _f1, ? AS _v2, 1 AS _f2" +
+				" UNION ALL SELECT ?, ?, ?, ?, 0, ?, 1, ?, 1" +
+				") s ON t.`id` = s._id SET " +
+				"t.`amount_cny` = IF(s._f0 = 1, s._v0, t.`amount_cny`), " +
+				"t.`recompute_info` = IF(s._f1 = 1, s._v1, t.`recompute_info`), " +
+				"t.`status` = IF(s._f2 = 1, s._v2, t.`status`) " +
+				"WHERE t.`status` = s._st AND t.`updated_at` <=> s._ver",
+			wantArgs: []any{uint64(1), 2, int64(5), "8.64", nil, 1, uint64(2), 2, int64(9), nil, "no rate", 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlStr, args := batchUpdateSQL("acc_expenses", "id", tt.versionCol, cols, rows, guards)
+			if sqlStr != tt.wantSQL {
+				t.Errorf("sql =\n%s\nwant\n%s", sqlStr, tt.wantSQL)
+			}
+			if n := strings.Count(sqlStr, "?"); n != len(args) {
+				t.Errorf("placeholders = %d, args = %d", n, len(args))
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestBatchUpdateChunks(t *testing.T) {
+	sqlDB, err := sql.Open("mysql", "u:p@tcp(127.0.0.1:1)/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sqlDB, SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stmts []int // 每條語句的參數數
+	err = db.Callback().Raw().After("gorm:raw").Register("test:count", func(tx *gorm.DB) {
+		stmts = append(stmts, len(tx.Statement.Vars))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		rows       int
+		versionCol string
+		wantStmts  int
+	}{
+		{name: "one statement", rows: 100, wantStmts: 1},
+		// 分段一律預留版本欄位：3 欄 + id/status/版本 = 6，每條最多 10922 筆
+		{name: "exactly one chunk", rows: 10922, wantStmts: 1},
+		{name: "one over", rows: 10923, wantStmts: 2},
+		{name: "split with version", rows: 30000, versionCol: "version", wantStmts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmts = nil
+			rows := make([]map[string]any, tt.rows)
+			guards := make(map[uint64]rowGuard, tt.rows)
+			for i := range rows {
+				id := uint64(i + 1)
+				rows[i] = map[string]any{"id": id, "amount_cny": "1", "status": 1, "recompute_info": nil}
+				guards[id] = rowGuard{Status: 2}
+			}
+			err := batchUpdate(context.Background(), db, "acc_expenses", "id", tt.versionCol, rows, guards, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stmts) != tt.wantStmts {
+				t.Fatalf("statements = %d, want %d", len(stmts), tt.wantStmts)
+			}
+			perRow := 5 // id、status + 3 欄
+			if tt.versionCol != "" {
+				perRow++
+			}
+			total := 0
+			for _, n := range stmts {
+				if n > mysqlMaxPlaceholders {
+					t.Errorf("statement has %d placeholders, over %d", n, mysqlMaxPlaceholders)
+				}
+				total += n
+			}
+			if total != tt.rows*perRow {
+				t.Errorf("total args = %d, want %d", total, tt.rows*perRow)
+			}
+		})
+	}
+}
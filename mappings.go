@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ---------- table mappings from YAML ----------
+
+// YAML 中的一張表；清單順序即處理順序。
+// 只寫 table（其餘欄位全空）代表沿用內建定義，方便只調整順序或挑選要跑的表。
+type tableMappingSpec struct {
+	Table        string `yaml:"table"`
+	FieldMapping `yaml:",inline"`
+}
+
+// mappings_file 的格式：與 config.yaml 的 tables 相同
+type mappingsFile struct {
+	Tables []tableMappingSpec `yaml:"tables"`
+}
+
+var identRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// 依 config 決定表對應與處理順序：mappings_file > config.tables > 內建預設
+func loadTableMappings(cfg Config) (map[string]FieldMapping, []string, string, error) {
+	specs := cfg.Tables
+	source := "config.tables"
+	if cfg.MappingsFile != "" {
+		b, err := os.ReadFile(cfg.MappingsFile)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		var mf mappingsFile
+		if err := yaml.Unmarshal(b, &mf); err != nil {
+			return nil, nil, "", fmt.Errorf("%s: %w", cfg.MappingsFile, err)
+		}
+		specs = mf.Tables
+		source = cfg.MappingsFile
+	}
+	if len(specs) == 0 {
+		return TableFieldMappings, TableOrder, "built-in", nil
+	}
+
+	mappings := make(map[string]FieldMapping, len(specs))
+	order := make([]string, 0, len(specs))
+	var errs []error
+	for i, sp := range specs {
+		name := strings.TrimSpace(sp.Table)
+		where := fmt.Sprintf("%s: tables[%d]", source, i)
+		if name == "" {
+			errs = append(errs, fmt.Errorf("%s: table name is empty", where))
+			continue
+		}
+		where += " (" + name + ")"
+		if _, dup := mappings[name]; dup {
+			errs = append(errs, fmt.Errorf("%s: duplicate table", where))
+			continue
+		}
+		m := sp.FieldMapping
+		if isEmptyMapping(m) {
+			builtin, ok := TableFieldMappings[name]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: no built-in mapping to inherit, define the columns", where))
+				continue
+			}
+			m = builtin
+			m.AutoDiscover = sp.AutoDiscover
+			m.VersionColumn = sp.VersionColumn
+		}
+		if m.IDColumn == "" {
+			m.IDColumn = "id"
+		}
+		if err := validateMapping(name, m); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+			continue
+		}
+		// auto_discover 的表要等 discover 之後才知道完整欄位，rounding 屆時再整理
+		if !m.AutoDiscover {
+			rules, err := canonicalRounding(m)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", where, err))
+				continue
+			}
+			m.Rounding = rules
+		}
+		mappings[name] = m
+		order = append(order, name)
+	}
+	if len(errs) > 0 {
+		return nil, nil, "", errors.Join(errs...)
+	}
+	return mappings, order, source, nil
+}
+
+// auto_discover、version_column 不算在內：只寫 table + auto_discover 代表沿用內建定義並補上自動找到的金額欄位
+func isEmptyMapping(m FieldMapping) bool {
+	return m.IDColumn == "" && m.MainCode == "" && m.SubCode == "" && m.SiteCode == "" &&
+		!m.OfficeOnly && len(m.AmountSets) == 0 && len(m.Rounding) == 0
+}
+
+func validateMapping(table string, m FieldMapping) error {
+	var errs []error
+	checkIdent := func(what, col string, required bool) {
+		if col == "" {
+			if required {
+				errs = append(errs, fmt.Errorf("%s is required", what))
+			}
+			return
+		}
+		if !identRe.MatchString(col) {
+			errs = append(errs, fmt.Errorf("%s %q is not a valid column name", what, col))
+		}
+	}
+	checkIdent("table", table, true)
+	checkIdent("id_column", m.IDColumn, true)
+	checkIdent("main_code", m.MainCode, false)
+	checkIdent("sub_code", m.SubCode, false)
+	checkIdent("site_code", m.SiteCode, false)
+	if m.VersionColumn != versionColumnNone {
+		checkIdent("version_column", m.VersionColumn, false)
+	}
+
+	if m.OfficeOnly && len(m.AmountSets) > 0 {
+		errs = append(errs, fmt.Errorf("office_only table must not define amount_sets"))
+	}
+	if m.OfficeOnly && m.AutoDiscover {
+		errs = append(errs, fmt.Errorf("office_only table must not set auto_discover"))
+	}
+	if !m.OfficeOnly && !m.AutoDiscover && len(m.AmountSets) == 0 {
+		errs = append(errs, fmt.Errorf("amount_sets is empty (set office_only for tables without amounts, or auto_discover)"))
+	}
+
+	seen := map[string]string{} // lower(col) -> 用途，MySQL 欄位名不分大小寫
+	for i, set := range m.AmountSets {
+		for _, c := range []struct{ what, col string }{
+			{fmt.Sprintf("amount_sets[%d].base", i), set.Base},
+			{fmt.Sprintf("amount_sets[%d].usdt", i), set.Usdt},
+			{fmt.Sprintf("amount_sets[%d].cny", i), set.Cny},
+		} {
+			checkIdent(c.what, c.col, true)
+			if c.col == "" {
+				continue
+			}
+			if prev, dup := seen[strings.ToLower(c.col)]; dup {
+				errs = append(errs, fmt.Errorf("%s %q already used by %s", c.what, c.col, prev))
+				continue
+			}
+			seen[strings.ToLower(c.col)] = c.what
+		}
+	}
+	for col, r := range m.Rounding {
+		if err := r.validate("rounding." + col); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rounding 的 key 統一成 amount_sets 中的寫法；不是換算後欄位就報錯
+func canonicalRounding(m FieldMapping) (map[string]RoundingRule, error) {
+	if len(m.Rounding) == 0 {
+		return m.Rounding, nil
+	}
+	var errs []error
+	rules := make(map[string]RoundingRule, len(m.Rounding))
+	for col, r := range m.Rounding {
+		target := outputColumn(m, col)
+		if target == "" {
+			errs = append(errs, fmt.Errorf("rounding: %q is not a converted (usdt/cny) column", col))
+			continue
+		}
+		rules[target] = r
+	}
+	return rules, errors.Join(errs...)
+}
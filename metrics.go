@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ---------- Prometheus metrics ----------
+
+// 批次各階段（stage label）
+const (
+	stageFetchIDs        = "fetch_ids"
+	stageFetchRecords    = "fetch_records"
+	stagePrefetchOffices = "prefetch_offices"
+	stagePrefetchRates   = "prefetch_rates"
+	stageUpdate          = "update"
+)
+
+var (
+	metricFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twacc_records_fetched_total",
+		Help: "Records fetched for recompute.",
+	}, []string{"table"})
+	metricConverted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twacc_records_converted_total",
+		Help: "Records written back as converted (status=1).",
+	}, []string{"table"})
+	metricFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twacc_records_failed_total",
+		Help: "Records that failed to convert, by reason category.",
+	}, []string{"table", "reason"})
+	metricStageSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "twacc_stage_duration_seconds",
+		Help:    "Latency of each batch stage.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14), // 5ms .. ~41s
+	}, []string{"table", "stage"})
+	metricUpdateRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twacc_update_rows_total",
+		Help: "Rows written by the batch UPDATE fast path or the per-row slow path.",
+	}, []string{"table", "path"})
+	metricConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "twacc_update_conflicts_total",
+		Help: "Rows skipped at write-back because status or the version column changed since they were read.",
+	}, []string{"table"})
+	metricPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "twacc_pending_records",
+		Help: "Records with status=2 at the end of the last pass over the table.",
+	}, []string{"table"})
+
+	// unix nano；0 代表還沒有 heartbeat
+	lastHeartbeat atomic.Int64
+	_             = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "twacc_seconds_since_heartbeat",
+		Help: "Seconds since the daemon loop last logged a heartbeat (-1 before the first one).",
+	}, func() float64 {
+		ns := lastHeartbeat.Load()
+		if ns == 0 {
+			return -1
+		}
+		return time.Since(time.Unix(0, ns)).Seconds()
+	})
+)
+
+// 用法：defer observeStage(table, stageX)()
+func observeStage(table, stage string) func() {
+	start := time.Now()
+	return func() {
+		metricStageSeconds.WithLabelValues(table, stage).Observe(time.Since(start).Seconds())
+	}
+}
+
+func markHeartbeat() {
+	lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+// 一輪結束後更新表的積壓量（只在有開 HTTP 時呼叫，避免多一次 COUNT）
+func refreshPending(ctx context.Context, env *recomputeEnv, table string) {
+	var n int64
+	err := env.DB.WithContext(ctx).Raw(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE status = 2", table)).Scan(&n).Error
+	if err != nil {
+		env.Logger.Warn("count pending error", logKeyTable, table, "err", err)
+		return
+	}
+	metricPending.WithLabelValues(table).Set(float64(n))
+}
+
+// ---------- HTTP ----------
+
+type HTTPConfig struct {
+	// 監聽位址，例如 :9090；空字串代表不開
+	Addr string `yaml:"addr"`
+	// /healthz：主迴圈超過這段時間沒處理完任何批次或表就回 503（預設 10m）
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+// daemon 背景啟動 /metrics、/healthz、/readyz；監聽失敗只記 log，不影響主迴圈
+func startHTTPServer(env *recomputeEnv) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthzHandler(env))
+	mux.Handle("/readyz", readyzHandler(env))
+	srv := &http.Server{Addr: env.Cfg.HTTP.Addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		env.BaseLogger.Info("http server listening", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			env.BaseLogger.Error("http server error", "addr", srv.Addr, "err", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// ---------- rate sources ----------
+
+// 匯率來源種類（config: rates.source）
+const (
+	rateSourceDB     = "db"
+	rateSourceFile   = "file"
+	rateSourceStatic = "static"
+)
+
+// 一筆匯率；Date 為 2006-01-02，空字串代表不限日期（僅 file/static 支援）
+type rateRecord struct {
+	Date string          `yaml:"date" json:"date"`
+	From string          `yaml:"from" json:"from"`
+	To   string          `yaml:"to" json:"to"`
+	Rate decimal.Decimal `yaml:"rate" json:"rate"`
+}
+
+// 匯率來源：回傳指定日期、幣別範圍內的匯率。
+// 同一 (date, from, to) 有多筆時，最新的要排在前面（prefetchRates 只收第一筆）。
+type RateSource interface {
+	Name() string
+	LoadRates(ctx context.Context, dates, froms, tos []string) ([]rateRecord, error)
+}
+
+func newRateSource(cfg RateConfig, db *gorm.DB) (RateSource, error) {
+	switch cfg.Source {
+	case "", rateSourceDB:
+		return &dbRateSource{db: db}, nil
+	case rateSourceFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("rates.source=file requires rates.file")
+		}
+		return loadRateFile(cfg.File)
+	case rateSourceStatic:
+		if len(cfg.Static) == 0 {
+			return nil, fmt.Errorf("rates.source=static requires rates.static entries")
+		}
+		return newMemoryRateSource("static", cfg.Static)
+	default:
+		return nil, fmt.Errorf("rates.source: unknown source %q (want db, file or static)", cfg.Source)
+	}
+}
+
+// ---------- MySQL: sys_currency_rate_record ----------
+
+type dbRateSource struct {
+	db *gorm.DB
+}
+
+func (s *dbRateSource) Name() string { return "db:sys_currency_rate_record" }
+
+func (s *dbRateSource) LoadRates(ctx context.Context, dates, froms, tos []string) ([]rateRecord, error) {
+	rows, err := s.db.WithContext(ctx).Raw(`
+        SELECT DATE(date_at) AS date_at, currency_from, currency_to, rate
+        FROM sys_currency_rate_record
+        WHERE deleted_at IS NULL
+          AND currency_to IN ?
+          AND DATE(date_at) IN ?
+          AND currency_from IN ?
+        ORDER BY id DESC
+    `, tos, dates, froms).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []rateRecord{}
+	for rows.Next() {
+		var r rateRecord
+		if err := rows.Scan(&r.Date, &r.From, &r.To, &r.Rate); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// ---------- 記憶體：file / static 共用 ----------
+
+type memoryRateSource struct {
+	name    string
+	records []rateRecord // 已反轉：檔案/設定中越後面的排越前面，視為較新
+}
+
+func newMemoryRateSource(name string, recs []rateRecord) (*memoryRateSource, error) {
+	out := make([]rateRecord, 0, len(recs))
+	for i := len(recs) - 1; i >= 0; i-- {
+		r := normalizeRateRecord(recs[i])
+		if r.From == "" || r.To == "" {
+			return nil, fmt.Errorf("%s: rate #%d missing from/to", name, i+1)
+		}
+		if r.Rate.Sign() <= 0 {
+			return nil, fmt.Errorf("%s: rate #%d %s->%s must be > 0", name, i+1, r.From, r.To)
+		}
+		if r.Date != "" {
+			if _, err := time.Parse("2006-01-02", r.Date); err != nil {
+				return nil, fmt.Errorf("%s: rate #%d bad date %q", name, i+1, r.Date)
+			}
+		}
+		out = append(out, r)
+	}
+	return &memoryRateSource{name: name, records: out}, nil
+}
+
+func (s *memoryRateSource) Name() string { return s.name }
+
+// 有日期的匯率優先於不限日期的匯率
+func (s *memoryRateSource) LoadRates(_ context.Context, dates, froms, tos []string) ([]rateRecord, error) {
+	dateSet := stringSet(dates)
+	fromSet := stringSet(froms)
+	toCur := stringSet(tos)
+	dated := []rateRecord{}
+	anyDay := []rateRecord{}
+	for _, r := range s.records {
+		if _, ok := fromSet[r.From]; !ok {
+			continue
+		}
+		if _, ok := toCur[r.To]; !ok {
+			continue
+		}
+		if r.Date == "" {
+			for _, d := range dates {
+				anyDay = append(anyDay, rateRecord{Date: d, From: r.From, To: r.To, Rate: r.Rate})
+			}
+			continue
+		}
+		if _, ok := dateSet[r.Date]; ok {
+			dated = append(dated, r)
+		}
+	}
+	return append(dated, anyDay...), nil
+}
+
+// 匯率檔：.csv（表頭 date,from,to,rate）或 .json（[{date,from,to,rate}]）
+func loadRateFile(path string) (*memoryRateSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []rateRecord
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.NewDecoder(f).Decode(&recs); err != nil {
+			return nil, fmt.Errorf("rate file %s: %w", path, err)
+		}
+	case ".csv":
+		recs, err = readRateCSV(f)
+		if err != nil {
+			return nil, fmt.Errorf("rate file %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("rate file %s: unsupported extension (want .csv or .json)", path)
+	}
+	return newMemoryRateSource("file:"+path, recs)
+}
+
+func readRateCSV(r io.Reader) ([]rateRecord, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	idx := map[string]int{}
+	for i, h := range header {
+		idx[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, h := range []string{"date", "from", "to", "rate"} {
+		if _, ok := idx[h]; !ok {
+			return nil, fmt.Errorf("csv header missing %q", h)
+		}
+	}
+
+	recs := []rateRecord{}
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rate, err := decimal.NewFromString(strings.TrimSpace(row[idx["rate"]]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad rate %q", line, row[idx["rate"]])
+		}
+		recs = append(recs, rateRecord{
+			Date: row[idx["date"]],
+			From: row[idx["from"]],
+			To:   row[idx["to"]],
+			Rate: rate,
+		})
+	}
+	return recs, nil
+}
+
+func normalizeRateRecord(r rateRecord) rateRecord {
+	r.Date = strings.TrimSpace(r.Date)
+	if len(r.Date) >= 10 { // 確保只留日期
+		r.Date = r.Date[:10]
+	}
+	r.From = strings.ToUpper(strings.TrimSpace(r.From))
+	r.To = strings.ToUpper(strings.TrimSpace(r.To))
+	return r
+}
+
+func stringSet(vals []string) map[string]struct{} {
+	m := make(map[string]struct{}, len(vals))
+	for _, v := range vals {
+		m[v] = struct{}{}
+	}
+	return m
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadRateCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []rateRecord
+		wantErr string
+	}{
+		{
+			name: "basic",
+			in:   "date,from,to,rate\n2024-01-05,PHP,CNY,0.128\n2024-01-05,CNY,USDT,0.14\n",
+			want: []rateRecord{
+				rate("2024-01-05", "PHP", "CNY", "0.128"),
+				rate("2024-01-05", "CNY", "USDT", "0.14"),
+			},
+		},
+		{
+			name: "header order, case and extra columns",
+			in:   "Rate, FROM ,source,To,DATE\n0.128, php,bank,cny,2024-01-05\n",
+			want: []rateRecord{rate("2024-01-05", "php", "cny", "0.128")},
+		},
+		{
+			name: "header only",
+			in:   "date,from,to,rate\n",
+			want: []rateRecord{},
+		},
+		{
+			name:    "empty file",
+			in:      "",
+			wantErr: "EOF",
+		},
+		{
+			name:    "missing column",
+			in:      "date,from,rate\n2024-01-05,PHP,0.128\n",
+			wantErr: `csv header missing "to"`,
+		},
+		{
+			name:    "bad rate reports line",
+			in:      "date,from,to,rate\n2024-01-05,PHP,CNY,0.128\n2024-01-05,CNY,USDT,n/a\n",
+			wantErr: `line 3: bad rate "n/a"`,
+		},
+		{
+			name:    "wrong field count",
+			in:      "date,from,to,rate\n2024-01-05,PHP,CNY\n",
+			wantErr: "wrong number of fields",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRateCSV(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d records, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				g, w := got[i], tt.want[i]
+				if g.Date != w.Date || g.From != w.From || g.To != w.To || !g.Rate.Equal(w.Rate) {
+					t.Errorf("record %d = %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
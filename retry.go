@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ---------- retry backoff ----------
+
+// 換算失敗的資料記在旁表，不動業務表結構。
+// 主鍵 (table_name, record_id)；成功後刪除，失敗時 attempts+1 並把 next_attempt_at 往後推。
+const retryTable = "acc_recompute_retry"
+
+type RetryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 第 n 次失敗後等待 base_delay × 2^(n-1)，最多 max_delay
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+	// 累計失敗 max_attempts 次後改為 terminal_status（預設 3），不再輪詢，需 requeue 才會重跑；0 = 不限次數
+	MaxAttempts    int `yaml:"max_attempts"`
+	TerminalStatus int `yaml:"terminal_status"`
+}
+
+func (c *RetryConfig) normalize() error {
+	if c.BaseDelay == 0 {
+		c.BaseDelay = time.Minute
+	}
+	if c.MaxDelay == 0 {
+		c.MaxDelay = 24 * time.Hour
+	}
+	if c.BaseDelay < 0 || c.MaxDelay < c.BaseDelay {
+		return fmt.Errorf("retry: need 0 < base_delay <= max_delay, got base_delay=%s max_delay=%s", c.BaseDelay, c.MaxDelay)
+	}
+	if c.TerminalStatus == 0 {
+		c.TerminalStatus = 3
+	}
+	if c.TerminalStatus == 1 || c.TerminalStatus == 2 || c.TerminalStatus < 0 {
+		return fmt.Errorf("retry.terminal_status must not be 1 or 2 (or negative), got %d", c.TerminalStatus)
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("retry.max_attempts must be >= 0, got %d", c.MaxAttempts)
+	}
+	if c.MaxAttempts > 0 && !c.Enabled {
+		return fmt.Errorf("retry.max_attempts needs retry.enabled (attempts are kept in %s)", retryTable)
+	}
+	return nil
+}
+
+// 這次失敗後（累計 attempts 次）是否該轉為 terminal_status
+func (c RetryConfig) exhausted(attempts int) bool {
+	return c.MaxAttempts > 0 && attempts >= c.MaxAttempts
+}
+
+// 第 attempts 次失敗之後要等多久
+func (c RetryConfig) delay(attempts int) time.Duration {
+	d := c.BaseDelay
+	for i := 1; i < attempts && d < c.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, c.MaxDelay)
+}
+
+func ensureRetryTable(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).Exec("CREATE TABLE IF NOT EXISTS `" + retryTable + "` (" +
+		"`table_name` VARCHAR(64) NOT NULL," +
+		"`record_id` BIGINT UNSIGNED NOT NULL," +
+		"`attempts` INT NOT NULL DEFAULT 0," +
+		"`next_attempt_at` DATETIME NOT NULL," +
+		"`last_reason` TEXT NULL," +
+		"`updated_at` DATETIME NOT NULL," +
+		"PRIMARY KEY (`table_name`, `record_id`)," +
+		"KEY `idx_next_attempt` (`table_name`, `next_attempt_at`)" +
+		") DEFAULT CHARSET=utf8mb4").Error
+}
+
+// fetchIDsAfterID 的額外條件：排除還在等待下次重試的資料。
+// 時間一律用 DB 的 NOW()，避免程式與 DB 時區不同。
+func retryFilter(table, idCol string) (string, []any) {
+	return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM `%s` r WHERE r.table_name = ? AND r.record_id = `%s`.`%s` AND r.next_attempt_at > NOW())",
+		retryTable, table, idCol), []any{table}
+}
+
+// 撈出這批 id 目前的失敗次數；沒有紀錄的不會出現在結果裡
+func loadRetryAttempts(ctx context.Context, db *gorm.DB, table string, ids []uint64) (map[uint64]int, error) {
+	out := map[uint64]int{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	rows, err := db.WithContext(ctx).Raw("SELECT record_id, attempts FROM `"+retryTable+"` WHERE table_name = ? AND record_id IN ?", table, ids).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uint64
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		out[id] = n
+	}
+	return out, rows.Err()
+}
+
+// 依本批結果更新旁表：成功的刪除，失敗的 attempts+1 並排定下次重試時間。
+// attempts 為計算前用 loadRetryAttempts 撈到的失敗次數。
+func recordRetries(ctx context.Context, db *gorm.DB, cfg RetryConfig, table string, attempts map[uint64]int, succeeded []uint64, failed map[uint64]string, logger *slog.Logger) error {
+	done := make([]uint64, 0, len(succeeded))
+	for _, id := range succeeded {
+		if _, ok := attempts[id]; ok {
+			done = append(done, id)
+		}
+	}
+	if len(done) > 0 {
+		err := db.WithContext(ctx).Exec("DELETE FROM `"+retryTable+"` WHERE table_name = ? AND record_id IN ?", table, done).Error
+		if err != nil {
+			return err
+		}
+	}
+	maxDelay := time.Duration(0)
+	if len(failed) > 0 {
+		q := "INSERT INTO `" + retryTable + "` (table_name, record_id, attempts, next_attempt_at, last_reason, updated_at) VALUES "
+		args := make([]any, 0, len(failed)*5)
+		i := 0
+		for id, reason := range failed {
+			n := attempts[id] + 1
+			d := cfg.delay(n)
+			maxDelay = max(maxDelay, d)
+			if i > 0 {
+				q += ","
+			}
+			q += "(?, ?, ?, NOW() + INTERVAL ? SECOND, ?, NOW())"
+			args = append(args, table, id, n, int64(d/time.Second), reason)
+			i++
+		}
+		q += " ON DUPLICATE KEY UPDATE attempts = VALUES(attempts), next_attempt_at = VALUES(next_attempt_at)," +
+			" last_reason = VALUES(last_reason), updated_at = VALUES(updated_at)"
+		if err := db.WithContext(ctx).Exec(q, args...).Error; err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 || len(done) > 0 {
+		logger.Info("retry state updated", logKeyTable, table, "failed", len(failed), "cleared", len(done), "max_next_delay", maxDelay.String())
+	}
+	return nil
+}
+
+// ---------- requeue ----------
+
+// 把 terminal_status 的資料改回 status=2 並清掉重試紀錄，下一輪輪詢就會重新處理。
+// ids 為空時處理整張表所有 terminal_status 的資料；指定 ids 時也會清掉這些 id 的退避時間。
+func requeueRecords(ctx context.Context, db *gorm.DB, cfg Config, table, idCol string, ids []uint64, logger *slog.Logger) (int64, error) {
+	if len(ids) == 0 {
+		q := fmt.Sprintf("SELECT `%s` FROM `%s` WHERE status = ? ORDER BY `%s`", idCol, table, idCol)
+		if err := db.WithContext(ctx).Raw(q, cfg.Retry.TerminalStatus).Scan(&ids).Error; err != nil {
+			return 0, err
+		}
+	}
+	var total int64
+	for start := 0; start < len(ids); start += cfg.RecomputeBatchSize {
+		chunk := ids[start:min(start+cfg.RecomputeBatchSize, len(ids))]
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			res := tx.Exec(fmt.Sprintf("UPDATE `%s` SET status = 2 WHERE `%s` IN ? AND status = ?", table, idCol), chunk, cfg.Retry.TerminalStatus)
+			if res.Error != nil {
+				return res.Error
+			}
+			total += res.RowsAffected
+			if !cfg.Retry.Enabled {
+				return nil
+			}
+			return tx.Exec("DELETE FROM `"+retryTable+"` WHERE table_name = ? AND record_id IN ?", table, chunk).Error
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+	logger.Info("requeue", logKeyTable, table, "ids", len(ids), "requeued", total)
+	return total, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	c := RetryConfig{BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: time.Minute},
+		{attempts: 1, want: time.Minute},
+		{attempts: 2, want: 2 * time.Minute},
+		{attempts: 3, want: 4 * time.Minute},
+		{attempts: 4, want: 8 * time.Minute},
+		{attempts: 5, want: 10 * time.Minute},
+		{attempts: 1000, want: 10 * time.Minute}, // 不會溢位
+	}
+	for _, tt := range tests {
+		if got := c.delay(tt.attempts); got != tt.want {
+			t.Errorf("delay(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+
+	c = RetryConfig{BaseDelay: time.Hour, MaxDelay: time.Hour}
+	if got := c.delay(3); got != time.Hour {
+		t.Errorf("base == max: delay(3) = %s, want 1h", got)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	tests := []struct {
+		max      int
+		attempts int
+		want     bool
+	}{
+		{max: 0, attempts: 100, want: false}, // 不限次數
+		{max: 3, attempts: 1, want: false},
+		{max: 3, attempts: 2, want: false},
+		{max: 3, attempts: 3, want: true},
+		{max: 3, attempts: 4, want: true},
+		{max: 1, attempts: 1, want: true},
+	}
+	for _, tt := range tests {
+		c := RetryConfig{MaxAttempts: tt.max}
+		if got := c.exhausted(tt.attempts); got != tt.want {
+			t.Errorf("max_attempts=%d exhausted(%d) = %v, want %v", tt.max, tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// ---------- rounding ----------
+
+// 捨入模式
+const (
+	roundHalfUp   = "half_up"   // 四捨五入（half away from zero），原 round2 的行為
+	roundHalfEven = "half_even" // 銀行家捨入
+	roundDown     = "down"      // 無條件捨去（toward zero）
+	roundUp       = "up"        // 無條件進位（away from zero）
+	roundCeiling  = "ceiling"   // 往正無限大
+	roundFloor    = "floor"     // 往負無限大
+)
+
+// 單一層級的捨入規則；空值代表沿用上一層
+type RoundingRule struct {
+	Mode   string `yaml:"mode"`
+	Places *int32 `yaml:"places"`
+}
+
+// 捨入設定：全域 -> 目標幣別 -> 表/欄位，越後面越優先
+type RoundingConfig struct {
+	RoundingRule `yaml:",inline"`
+	Currencies   map[string]RoundingRule            `yaml:"currencies"` // key: CNY / USDT
+	Tables       map[string]map[string]RoundingRule `yaml:"tables"`     // table -> 換算後欄位 -> 規則
+}
+
+func (r RoundingRule) validate(where string) error {
+	switch r.Mode {
+	case "", roundHalfUp, roundHalfEven, roundDown, roundUp, roundCeiling, roundFloor:
+	default:
+		return fmt.Errorf("%s: unknown rounding mode %q", where, r.Mode)
+	}
+	if r.Places != nil && (*r.Places < 0 || *r.Places > 18) {
+		return fmt.Errorf("%s: rounding places must be 0..18, got %d", where, *r.Places)
+	}
+	return nil
+}
+
+// 上層規則被下層有設定的欄位覆蓋
+func (r RoundingRule) merge(o RoundingRule) RoundingRule {
+	if o.Mode != "" {
+		r.Mode = o.Mode
+	}
+	if o.Places != nil {
+		r.Places = o.Places
+	}
+	return r
+}
+
+// 未設定 places 時保留 2 位（原 round2 的行為）
+func (r RoundingRule) placesOrDefault() int32 {
+	if r.Places != nil {
+		return *r.Places
+	}
+	return 2
+}
+
+func (r RoundingRule) apply(v decimal.Decimal) decimal.Decimal {
+	places := r.placesOrDefault()
+	switch r.Mode {
+	case roundHalfEven:
+		return v.RoundBank(places)
+	case roundDown:
+		return v.RoundDown(places)
+	case roundUp:
+		return v.RoundUp(places)
+	case roundCeiling:
+		return v.RoundCeil(places)
+	case roundFloor:
+		return v.RoundFloor(places)
+	default:
+		return v.Round(places)
+	}
+}
+
+func (r RoundingRule) String() string {
+	places := r.placesOrDefault()
+	mode := r.Mode
+	if mode == "" {
+		mode = roundHalfUp
+	}
+	return fmt.Sprintf("%s/%d", mode, places)
+}
+
+// 正規化並檢查設定；幣別 key 統一大寫
+func (c *RoundingConfig) normalize() error {
+	if err := c.RoundingRule.validate("rounding"); err != nil {
+		return err
+	}
+	cur := make(map[string]RoundingRule, len(c.Currencies))
+	for k, r := range c.Currencies {
+		k = strings.ToUpper(strings.TrimSpace(k))
+		if err := r.validate("rounding.currencies." + k); err != nil {
+			return err
+		}
+		cur[k] = r
+	}
+	c.Currencies = cur
+	for tbl, cols := range c.Tables {
+		for col, r := range cols {
+			if err := r.validate("rounding.tables." + tbl + "." + col); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 把 rounding.tables 的欄位規則套進表對應，欄位必須是某組金額的 usdt/cny 欄位
+func applyRoundingOverrides(rc RoundingConfig, mappings map[string]FieldMapping) error {
+	for tbl, cols := range rc.Tables {
+		m, ok := mappings[tbl]
+		if !ok {
+			return fmt.Errorf("rounding.tables: unknown table %q", tbl)
+		}
+		rules := make(map[string]RoundingRule, len(m.Rounding)+len(cols))
+		for col, r := range m.Rounding {
+			rules[col] = r
+		}
+		for col, r := range cols {
+			target := outputColumn(m, col)
+			if target == "" {
+				return fmt.Errorf("rounding.tables.%s: %q is not a converted (usdt/cny) column", tbl, col)
+			}
+			rules[target] = rules[target].merge(r)
+		}
+		m.Rounding = rules
+		mappings[tbl] = m
+	}
+	return nil
+}
+
+// 找出 col 對應的換算後欄位（不分大小寫），回傳 mapping 中的原始寫法
+func outputColumn(m FieldMapping, col string) string {
+	for _, s := range m.AmountSets {
+		if strings.EqualFold(s.Usdt, col) {
+			return s.Usdt
+		}
+		if strings.EqualFold(s.Cny, col) {
+			return s.Cny
+		}
+	}
+	return ""
+}
+
+// 決定某個換算後欄位實際使用的規則：全域 -> 目標幣別 -> 表/欄位
+func roundingFor(rc RoundingConfig, mapping FieldMapping, col, target string) RoundingRule {
+	r := RoundingRule{Mode: roundHalfUp}.merge(rc.RoundingRule)
+	if cr, ok := rc.Currencies[target]; ok {
+		r = r.merge(cr)
+	}
+	if mr, ok := mapping.Rounding[col]; ok {
+		r = r.merge(mr)
+	}
+	return r
+}
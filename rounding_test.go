@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func places(n int32) *int32 { return &n }
+
+func TestRoundingRuleApply(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RoundingRule
+		in   string
+		want string
+	}{
+		{name: "default half_up 2 places", rule: RoundingRule{}, in: "1.005", want: "1.01"},
+		{name: "half_up negative away from zero", rule: RoundingRule{Mode: roundHalfUp}, in: "-1.005", want: "-1.01"},
+		{name: "half_even to even", rule: RoundingRule{Mode: roundHalfEven}, in: "1.005", want: "1"},
+		{name: "half_even odd rounds up", rule: RoundingRule{Mode: roundHalfEven}, in: "1.015", want: "1.02"},
+		{name: "down toward zero", rule: RoundingRule{Mode: roundDown}, in: "-1.239", want: "-1.23"},
+		{name: "up away from zero", rule: RoundingRule{Mode: roundUp}, in: "-1.231", want: "-1.24"},
+		{name: "ceiling negative", rule: RoundingRule{Mode: roundCeiling}, in: "-1.239", want: "-1.23"},
+		{name: "floor negative", rule: RoundingRule{Mode: roundFloor}, in: "-1.231", want: "-1.24"},
+		{name: "zero places", rule: RoundingRule{Places: places(0)}, in: "2.5", want: "3"},
+		{name: "six places", rule: RoundingRule{Mode: roundDown, Places: places(6)}, in: "0.01792349", want: "0.017923"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.apply(decimal.RequireFromString(tt.in))
+			if !got.Equal(decimal.RequireFromString(tt.want)) {
+				t.Errorf("apply(%s) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundingRuleMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		base, o RoundingRule
+		want    string
+	}{
+		{name: "empty keeps base", base: RoundingRule{Mode: roundDown, Places: places(4)}, want: "down/4"},
+		{name: "mode only", base: RoundingRule{Mode: roundDown, Places: places(4)}, o: RoundingRule{Mode: roundUp}, want: "up/4"},
+		{name: "places only", base: RoundingRule{Mode: roundDown}, o: RoundingRule{Places: places(0)}, want: "down/0"},
+		{name: "both", base: RoundingRule{Mode: roundDown, Places: places(4)}, o: RoundingRule{Mode: roundFloor, Places: places(6)}, want: "floor/6"},
+		{name: "unset defaults", want: "half_up/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.base.merge(tt.o).String(); got != tt.want {
+				t.Errorf("merge = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundingFor(t *testing.T) {
+	rc := RoundingConfig{
+		RoundingRule: RoundingRule{Mode: roundHalfEven},
+		Currencies: map[string]RoundingRule{
+			"USDT": {Places: places(6)},
+		},
+	}
+	mapping := FieldMapping{Rounding: map[string]RoundingRule{
+		"amount_usdt": {Mode: roundDown},
+		"fee_cny":     {Places: places(0)},
+	}}
+	tests := []struct {
+		name   string
+		rc     RoundingConfig
+		col    string
+		target string
+		want   string
+	}{
+		{name: "no config", rc: RoundingConfig{}, col: "amount_cny", target: "CNY", want: "half_up/2"},
+		{name: "global", rc: rc, col: "amount_cny", target: "CNY", want: "half_even/2"},
+		{name: "currency over global", rc: rc, col: "fee_usdt", target: "USDT", want: "half_even/6"},
+		{name: "column over currency", rc: rc, col: "amount_usdt", target: "USDT", want: "down/6"},
+		{name: "column places over global", rc: rc, col: "fee_cny", target: "CNY", want: "half_even/0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roundingFor(tt.rc, mapping, tt.col, tt.target).String(); got != tt.want {
+				t.Errorf("roundingFor(%s) = %s, want %s", tt.col, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ---------- startup schema check ----------
+
+// 發現問題時的處理方式（config: schema_check）
+const (
+	schemaCheckFail    = "fail"    // 拒絕啟動（預設）
+	schemaCheckDisable = "disable" // 只停用有問題的表
+	schemaCheckOff     = "off"     // 不檢查
+)
+
+type columnInfo struct {
+	Name     string // information_schema 中的實際寫法
+	DataType string // DATA_TYPE，小寫，例如 decimal / bigint / varchar
+	Position int    // ORDINAL_POSITION
+	Scale    *int   // NUMERIC_SCALE；非數值型別為 nil
+}
+
+// key: 小寫欄位名（MySQL 欄位名不分大小寫）
+type tableColumns map[string]columnInfo
+
+type schemaIssue struct {
+	Table   string
+	Column  string
+	Problem string
+	Warn    bool // 只提示，不視為錯誤
+}
+
+func (i schemaIssue) String() string {
+	if i.Column == "" {
+		return fmt.Sprintf("%s: %s", i.Table, i.Problem)
+	}
+	return fmt.Sprintf("%s.%s: %s", i.Table, i.Column, i.Problem)
+}
+
+var numericTypes = map[string]bool{
+	"decimal": true, "numeric": true, "float": true, "double": true, "real": true,
+	"tinyint": true, "smallint": true, "mediumint": true, "int": true, "integer": true, "bigint": true,
+}
+
+var integerTypes = map[string]bool{
+	"tinyint": true, "smallint": true, "mediumint": true, "int": true, "integer": true, "bigint": true,
+}
+
+// 一次撈出所有表在目前資料庫的欄位定義；不存在的表不會出現在結果裡
+func loadTableColumns(ctx context.Context, db *gorm.DB, tables []string) (map[string]tableColumns, error) {
+	out := make(map[string]tableColumns, len(tables))
+	if len(tables) == 0 {
+		return out, nil
+	}
+	rows, err := db.WithContext(ctx).Raw(`
+		SELECT TABLE_NAME, COLUMN_NAME, DATA_TYPE, ORDINAL_POSITION, NUMERIC_SCALE
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME IN ?
+	`, tables).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tbl, col, typ string
+		var pos int
+		var scale sql.NullInt64
+		if err := rows.Scan(&tbl, &col, &typ, &pos, &scale); err != nil {
+			return nil, err
+		}
+		if out[tbl] == nil {
+			out[tbl] = tableColumns{}
+		}
+		ci := columnInfo{Name: col, DataType: strings.ToLower(typ), Position: pos}
+		if scale.Valid {
+			n := int(scale.Int64)
+			ci.Scale = &n
+		}
+		out[tbl][strings.ToLower(col)] = ci
+	}
+	return out, rows.Err()
+}
+
+// 檢查一張表：讀寫會用到的欄位都要存在，金額欄位需為數值型別
+func checkTableSchema(table string, m FieldMapping, cols tableColumns) []schemaIssue {
+	if len(cols) == 0 {
+		return []schemaIssue{{Table: table, Problem: "table not found in information_schema"}}
+	}
+	var issues []schemaIssue
+	seen := map[string]bool{}
+	check := func(col, role string, types map[string]bool, typeDesc string) {
+		if col == "" || seen[strings.ToLower(col)+role] {
+			return
+		}
+		seen[strings.ToLower(col)+role] = true
+		ci, ok := cols[strings.ToLower(col)]
+		if !ok {
+			issues = append(issues, schemaIssue{Table: table, Column: col, Problem: role + " column does not exist"})
+			return
+		}
+		if ci.Name != col {
+			issues = append(issues, schemaIssue{Table: table, Column: col, Warn: true,
+				Problem: fmt.Sprintf("%s column case differs from schema (%s)", role, ci.Name)})
+		}
+		if types != nil && !types[ci.DataType] {
+			issues = append(issues, schemaIssue{Table: table, Column: col,
+				Problem: fmt.Sprintf("%s column has type %s, want %s", role, ci.DataType, typeDesc)})
+		}
+	}
+
+	check(m.IDColumn, "id", integerTypes, "an integer type")
+	check(m.MainCode, "main code", nil, "")
+	check(m.SubCode, "sub code", nil, "")
+	check(m.SiteCode, "site code", nil, "")
+	// computeUpdateCached 補辦公室時寫入的欄位（main/sub/site code 上面已檢查過）
+	for _, c := range officeColumns(m) {
+		if c != m.MainCode && c != m.SubCode && c != m.SiteCode {
+			check(c, "office", nil, "")
+		}
+	}
+	check("status", "status", integerTypes, "an integer type")
+	check("recompute_info", "recompute_info", nil, "")
+	check(m.versionColumn(), "version", nil, "")
+	if !m.OfficeOnly {
+		check("currency", "currency", nil, "")
+		check("entry_date", "entry_date", nil, "")
+	}
+	for _, s := range m.AmountSets {
+		check(s.Base, "amount", numericTypes, "a numeric type")
+		check(s.Usdt, "amount", numericTypes, "a numeric type")
+		check(s.Cny, "amount", numericTypes, "a numeric type")
+	}
+	return issues
+}
+
+// 捨入位數不能超過 DECIMAL 欄位的小數位數，否則寫入時會被 MySQL 再截一次、不會報錯
+func checkRoundingScale(table string, m FieldMapping, cols tableColumns, rc RoundingConfig) []schemaIssue {
+	var issues []schemaIssue
+	for _, s := range m.AmountSets {
+		for _, out := range []struct{ col, target string }{{s.Usdt, "USDT"}, {s.Cny, "CNY"}} {
+			ci, ok := cols[strings.ToLower(out.col)]
+			if !ok || ci.Scale == nil || (ci.DataType != "decimal" && ci.DataType != "numeric") {
+				continue
+			}
+			rule := roundingFor(rc, m, out.col, out.target)
+			if places := rule.placesOrDefault(); int(places) > *ci.Scale {
+				issues = append(issues, schemaIssue{Table: table, Column: out.col,
+					Problem: fmt.Sprintf("rounding %s keeps %d decimal places but the column scale is %d", rule, places, *ci.Scale)})
+			}
+		}
+	}
+	return issues
+}
+
+// 啟動時檢查所有表；回傳可以處理的表（依原順序）。
+// fail：有任何錯誤就回傳 error；disable：停用有錯誤的表，全部停用才回傳 error。
+func validateSchema(schema map[string]tableColumns, mappings map[string]FieldMapping, order []string, mode string, rc RoundingConfig, logger *slog.Logger) ([]string, error) {
+	if mode == schemaCheckOff {
+		logger.Info("schema check disabled")
+		return order, nil
+	}
+
+	enabled := make([]string, 0, len(order))
+	var failed []string
+	for _, tbl := range order {
+		issues := checkTableSchema(tbl, mappings[tbl], schema[tbl])
+		issues = append(issues, checkRoundingScale(tbl, mappings[tbl], schema[tbl], rc)...)
+		bad := false
+		for _, is := range issues {
+			if is.Warn {
+				logger.Warn("schema issue", logKeyTable, is.Table, "column", is.Column, "problem", is.Problem)
+				continue
+			}
+			bad = true
+			logger.Error("schema issue", logKeyTable, is.Table, "column", is.Column, "problem", is.Problem)
+		}
+		if bad {
+			failed = append(failed, tbl)
+			continue
+		}
+		enabled = append(enabled, tbl)
+	}
+
+	if len(failed) == 0 {
+		logger.Info("schema ok", "tables", len(enabled))
+		return enabled, nil
+	}
+	if mode == schemaCheckDisable && len(enabled) > 0 {
+		logger.Warn("schema check disabled tables", "disabled", failed, "enabled", enabled)
+		return enabled, nil
+	}
+	return nil, fmt.Errorf("schema check failed for tables %v (see schema issue log lines)", failed)
+}
+
+// ---------- amount set auto-discovery ----------
+
+const (
+	usdtSuffix = "_usdt"
+	cnySuffix  = "_cny"
+)
+
+// 依命名慣例找出 X / X_usdt / X_cny 三欄一組的金額欄位（不分大小寫，皆須為數值型別）。
+// 已在 existing 中的 base 欄位不重複加入；只有 _usdt 或 _cny 其中一邊、或找不到 base 的欄位列為 orphans。
+func discoverAmountSets(cols tableColumns, existing []AmountFieldSet) ([]AmountFieldSet, []string) {
+	known := map[string]bool{}
+	for _, s := range existing {
+		known[strings.ToLower(s.Base)] = true
+		known[strings.ToLower(s.Usdt)] = true
+		known[strings.ToLower(s.Cny)] = true
+	}
+	numeric := func(lower string) (columnInfo, bool) {
+		ci, ok := cols[lower]
+		return ci, ok && numericTypes[ci.DataType]
+	}
+
+	// 依欄位順序處理，結果穩定且與表定義一致
+	ordered := make([]columnInfo, 0, len(cols))
+	for _, ci := range cols {
+		ordered = append(ordered, ci)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Position < ordered[j].Position })
+
+	var found []AmountFieldSet
+	var orphans []string
+	for _, ci := range ordered {
+		lower := strings.ToLower(ci.Name)
+		if known[lower] || !numericTypes[ci.DataType] {
+			continue
+		}
+		var stem string
+		switch {
+		case strings.HasSuffix(lower, usdtSuffix):
+			stem = strings.TrimSuffix(lower, usdtSuffix)
+		case strings.HasSuffix(lower, cnySuffix):
+			stem = strings.TrimSuffix(lower, cnySuffix)
+		default:
+			continue
+		}
+		base, okBase := numeric(stem)
+		usdt, okUsdt := numeric(stem + usdtSuffix)
+		cny, okCny := numeric(stem + cnySuffix)
+		switch {
+		case !okBase:
+			orphans = append(orphans, ci.Name+" (no base column "+stem+")")
+		case !okUsdt:
+			orphans = append(orphans, ci.Name+" (no "+stem+usdtSuffix+" column)")
+		case !okCny:
+			orphans = append(orphans, ci.Name+" (no "+stem+cnySuffix+" column)")
+		case !known[stem]:
+			found = append(found, AmountFieldSet{Base: base.Name, Usdt: usdt.Name, Cny: cny.Name})
+		}
+		known[stem] = true
+		if okUsdt {
+			known[stem+usdtSuffix] = true
+		}
+		if okCny {
+			known[stem+cnySuffix] = true
+		}
+	}
+	return found, orphans
+}
+
+// 對 auto_discover 的表補齊 AmountSets 並整理 rounding；表不存在或仍無金額欄位時回傳 error
+func applyAutoDiscover(schema map[string]tableColumns, mappings map[string]FieldMapping, order []string, logger *slog.Logger) error {
+	var errs []error
+	for _, tbl := range order {
+		m := mappings[tbl]
+		if !m.AutoDiscover {
+			continue
+		}
+		cols := schema[tbl]
+		if len(cols) == 0 {
+			errs = append(errs, fmt.Errorf("auto_discover %s: table not found in information_schema", tbl))
+			continue
+		}
+		found, orphans := discoverAmountSets(cols, m.AmountSets)
+		for _, o := range orphans {
+			logger.Warn("orphan amount column", logKeyTable, tbl, "column", o)
+		}
+		for _, s := range found {
+			logger.Info("discovered amount set", logKeyTable, tbl, "base", s.Base, "usdt", s.Usdt, "cny", s.Cny)
+		}
+		m.AmountSets = append(append([]AmountFieldSet{}, m.AmountSets...), found...)
+		if len(m.AmountSets) == 0 {
+			errs = append(errs, fmt.Errorf("auto_discover %s: no amount sets found", tbl))
+			continue
+		}
+		rules, err := canonicalRounding(m)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("auto_discover %s: %w", tbl, err))
+			continue
+		}
+		m.Rounding = rules
+		mappings[tbl] = m
+		logger.Info("auto_discover", logKeyTable, tbl, "amount_sets", len(m.AmountSets), "discovered", len(found), "orphans", len(orphans))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// "name:type" 依順序組成 tableColumns
+func testColumns(defs ...string) tableColumns {
+	cols := tableColumns{}
+	for i, d := range defs {
+		name, typ, _ := strings.Cut(d, ":")
+		cols[strings.ToLower(name)] = columnInfo{Name: name, DataType: typ, Position: i + 1}
+	}
+	return cols
+}
+
+func TestDiscoverAmountSets(t *testing.T) {
+	tests := []struct {
+		name        string
+		cols        tableColumns
+		existing    []AmountFieldSet
+		wantSets    []AmountFieldSet
+		wantOrphans []string
+	}{
+		{
+			name:     "one set keeps column case",
+			cols:     testColumns("id:bigint", "Amount:decimal", "Amount_USDT:decimal", "amount_cny:decimal"),
+			wantSets: []AmountFieldSet{{Base: "Amount", Usdt: "Amount_USDT", Cny: "amount_cny"}},
+		},
+		{
+			name: "sets in column order",
+			cols: testColumns("fee_cny:decimal", "amount:decimal", "fee:int", "amount_usdt:decimal", "fee_usdt:double", "amount_cny:decimal"),
+			wantSets: []AmountFieldSet{
+				{Base: "fee", Usdt: "fee_usdt", Cny: "fee_cny"},
+				{Base: "amount", Usdt: "amount_usdt", Cny: "amount_cny"},
+			},
+		},
+		{
+			name:     "existing set not repeated",
+			cols:     testColumns("amount:decimal", "amount_usdt:decimal", "amount_cny:decimal", "tax:decimal", "tax_usdt:decimal", "tax_cny:decimal"),
+			existing: []AmountFieldSet{{Base: "AMOUNT", Usdt: "amount_usdt", Cny: "amount_cny"}},
+			wantSets: []AmountFieldSet{{Base: "tax", Usdt: "tax_usdt", Cny: "tax_cny"}},
+		},
+		{
+			name:        "missing cny side",
+			cols:        testColumns("fee:decimal", "fee_usdt:decimal"),
+			wantOrphans: []string{"fee_usdt (no fee_cny column)"},
+		},
+		{
+			name:        "missing base reported once",
+			cols:        testColumns("tax_usdt:decimal", "tax_cny:decimal"),
+			wantOrphans: []string{"tax_usdt (no base column tax)"},
+		},
+		{
+			name:        "non-numeric columns ignored",
+			cols:        testColumns("remark:varchar", "remark_usdt:varchar", "remark_cny:varchar", "rate:varchar", "rate_cny:decimal", "rate_usdt:decimal"),
+			wantOrphans: []string{"rate_cny (no base column rate)"},
+		},
+		{
+			name: "no suffixed columns",
+			cols: testColumns("id:bigint", "amount:decimal", "currency:varchar"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sets, orphans := discoverAmountSets(tt.cols, tt.existing)
+			if !reflect.DeepEqual(sets, tt.wantSets) {
+				t.Errorf("sets = %+v, want %+v", sets, tt.wantSets)
+			}
+			if !reflect.DeepEqual(orphans, tt.wantOrphans) {
+				t.Errorf("orphans = %q, want %q", orphans, tt.wantOrphans)
+			}
+		})
+	}
+}